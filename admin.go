@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Require the X-Admin-Key header to match ADMIN_API_KEY. When no key is
+// configured the admin routes are disabled entirely.
+func adminAuthMiddleware(key string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key == "" {
+				writeError(w, http.StatusNotFound, "Admin endpoints are disabled")
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Key")), []byte(key)) != 1 {
+				writeError(w, http.StatusUnauthorized, "Invalid admin key")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// maintenanceRunning guards against overlapping maintenance runs.
+var maintenanceRunning int32
+
+// Refresh planner statistics and, with ?reindex=true, rebuild indexes
+func maintenanceHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !atomic.CompareAndSwapInt32(&maintenanceRunning, 0, 1) {
+			writeError(w, http.StatusConflict, "Maintenance is already running")
+			return
+		}
+		defer atomic.StoreInt32(&maintenanceRunning, 0)
+
+		tx, err := beginUntimed(r.Context(), db)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to start maintenance")
+			return
+		}
+		defer tx.Rollback()
+
+		response := map[string]interface{}{}
+		start := time.Now()
+		if _, err := tx.ExecContext(r.Context(), "ANALYZE "+table); err != nil {
+			log.Println("ANALYZE failed:", err)
+			writeError(w, http.StatusInternalServerError, "Failed to analyze table")
+			return
+		}
+		response["analyze_ms"] = time.Since(start).Milliseconds()
+
+		if r.URL.Query().Get("reindex") == "true" {
+			start = time.Now()
+			if _, err := tx.ExecContext(r.Context(), "REINDEX TABLE "+table); err != nil {
+				log.Println("REINDEX failed:", err)
+				writeError(w, http.StatusInternalServerError, "Failed to reindex table")
+				return
+			}
+			response["reindex_ms"] = time.Since(start).Milliseconds()
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to finish maintenance")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, response)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// maxBatchSize caps the operations in one batch request; set from
+// MAX_BATCH_SIZE.
+var maxBatchSize = 500
+
+// batchOp is one operation of a batch request.
+type batchOp struct {
+	Op   string          `json:"op"`
+	ID   UserID          `json:"id"`
+	Data json.RawMessage `json:"data"`
+}
+
+// batchResult is the outcome of one operation: its status code and either
+// the record or an error message.
+type batchResult struct {
+	Status int         `json:"status"`
+	Data   interface{} `json:"data,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// batchChange is a committed write, notified once its transaction is in.
+type batchChange struct {
+	operation string
+	record    interface{}
+}
+
+var errBatchFailed = errors.New("batch operation failed")
+
+// Run an array of create, update, delete and get operations, answering
+// with one result per operation in the same order. Each operation commits
+// on its own unless ?atomic=true, which runs them all in one transaction
+// and rolls everything back at the first failure.
+func batchUsers(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ops []batchOp
+		if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+			writeError(w, http.StatusBadRequest, "Body must be an array of operations")
+			return
+		}
+		if len(ops) > maxBatchSize {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Batch has %d operations; at most %d are allowed", len(ops), maxBatchSize))
+			return
+		}
+
+		ctx := r.Context()
+		results := make([]batchResult, len(ops))
+		var changes []batchChange
+
+		if r.URL.Query().Get("atomic") == "true" {
+			failed := -1
+			err := runWrite(ctx, db, func(tx *sql.Tx) error {
+				changes = changes[:0]
+				for i, op := range ops {
+					res, change, err := runBatchOp(ctx, tx, op)
+					if err != nil {
+						return err
+					}
+					results[i] = res
+					if res.Status >= 400 {
+						failed = i
+						return errBatchFailed
+					}
+					if change != nil {
+						changes = append(changes, *change)
+					}
+				}
+				return nil
+			})
+			if err == errBatchFailed {
+				for i := range results {
+					if i != failed {
+						results[i] = batchResult{Status: http.StatusFailedDependency, Error: "Rolled back because operation " + strconv.Itoa(failed) + " failed"}
+					}
+				}
+				changes = nil
+			} else if err != nil {
+				writeWriteError(w, err, "Failed to run batch")
+				return
+			}
+		} else {
+			for i, op := range ops {
+				var change *batchChange
+				err := runWrite(ctx, db, func(tx *sql.Tx) (err error) {
+					results[i], change, err = runBatchOp(ctx, tx, op)
+					if err == nil && results[i].Status >= 400 {
+						err = errBatchFailed
+					}
+					return err
+				})
+				switch {
+				case err == errWriteContention:
+					results[i] = batchResult{Status: http.StatusServiceUnavailable, Error: "Database is busy, please retry"}
+				case err != nil && err != errBatchFailed:
+					results[i] = batchResult{Status: http.StatusInternalServerError, Error: "Failed to run operation"}
+				case change != nil:
+					changes = append(changes, *change)
+				}
+			}
+		}
+
+		for _, c := range changes {
+			notifyChange(c.operation, c.record)
+		}
+		writeJSON(w, http.StatusOK, results)
+	}
+}
+
+// Run one operation in tx with the same rules as its own endpoint. The
+// result carries client errors such as 404 or 422; err is a database
+// failure, to be handled by runWrite.
+func runBatchOp(ctx context.Context, tx *sql.Tx, op batchOp) (batchResult, *batchChange, error) {
+	fail := func(status int, message string) (batchResult, *batchChange, error) {
+		return batchResult{Status: status, Error: message}, nil, nil
+	}
+	switch op.Op {
+	case "create", "update", "delete", "get":
+	default:
+		return fail(http.StatusBadRequest, fmt.Sprintf("Unknown op %q; must be create, update, delete or get", op.Op))
+	}
+	if op.Op != "create" && op.ID == 0 {
+		return fail(http.StatusBadRequest, "id is required")
+	}
+	id := strconv.Itoa(int(op.ID))
+
+	switch op.Op {
+	case "create":
+		var u User
+		if err := json.Unmarshal(op.Data, &u); err != nil {
+			return fail(http.StatusBadRequest, "Invalid data")
+		}
+		if u.Tags == nil {
+			u.Tags = []string{}
+		}
+		if err := validateCreate(&u); err != nil {
+			return fail(http.StatusUnprocessableEntity, err.Error())
+		}
+		if err := insertUser(ctx, tx, &u); err != nil {
+			return batchResult{}, nil, err
+		}
+		return batchResult{Status: http.StatusCreated, Data: u}, &batchChange{"create", u}, nil
+
+	case "update":
+		u, present, err := decodeUpdate(op.Data, id)
+		if err == errIDMismatch {
+			return fail(http.StatusBadRequest, err.Error())
+		} else if err != nil {
+			return fail(http.StatusBadRequest, "Invalid data")
+		}
+		if err := validateUpdate(&u, present); err != nil {
+			return fail(http.StatusUnprocessableEntity, err.Error())
+		}
+		if err := updateUserRow(ctx, tx, id, &u, present); err == sql.ErrNoRows {
+			return fail(http.StatusNotFound, "User not found")
+		} else if err != nil {
+			return batchResult{}, nil, err
+		}
+		return batchResult{Status: http.StatusOK, Data: u}, &batchChange{"update", u}, nil
+
+	case "delete":
+		deleted, err := deleteUserRow(ctx, tx, id)
+		if err == sql.ErrNoRows {
+			return fail(http.StatusNotFound, "User not found")
+		} else if err != nil {
+			return batchResult{}, nil, err
+		}
+		record := map[string]UserID{"id": deleted}
+		return batchResult{Status: http.StatusOK, Data: record}, &batchChange{"delete", record}, nil
+	}
+
+	// What is left is get
+	var u User
+	err := tx.QueryRowContext(ctx, "SELECT "+selectList(userColumns)+" FROM "+table+" WHERE id = $1", id).Scan(scanTargets(&u, userColumns)...)
+	if err == sql.ErrNoRows {
+		return fail(http.StatusNotFound, "User not found")
+	} else if err != nil {
+		return batchResult{}, nil, err
+	}
+	return batchResult{Status: http.StatusOK, Data: u}, nil, nil
+}
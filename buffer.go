@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// writeBuffer batches unconditional creates for burst ingestion. Callers
+// queue a user and wait; a background worker inserts the queue with one
+// multi-row INSERT every size records or interval, whichever comes first.
+type writeBuffer struct {
+	db       *sql.DB
+	size     int
+	interval time.Duration
+	queue    chan *bufferedCreate
+	done     chan struct{}
+
+	// mu guards closing queue: creates send under the read lock, so close
+	// never closes it under a sender, and refuse once closed is set
+	mu     sync.RWMutex
+	closed bool
+}
+
+type bufferedCreate struct {
+	u      *User
+	result chan error
+}
+
+func newWriteBuffer(db *sql.DB, size int, interval time.Duration) *writeBuffer {
+	return &writeBuffer{db: db, size: size, interval: interval,
+		queue: make(chan *bufferedCreate, size), done: make(chan struct{})}
+}
+
+// errBufferClosed is returned from a create made after close has started.
+var errBufferClosed = errors.New("write buffer is closed")
+
+// Queue u for insertion and wait until its batch is committed, filling u
+// from the stored row. A caller cancelled while waiting for room in the
+// queue gives up; once queued it waits for the batch whatever happens to
+// ctx, so it never reports failure for a row that was in fact stored.
+func (b *writeBuffer) create(ctx context.Context, u *User) error {
+	req := &bufferedCreate{u: u, result: make(chan error, 1)}
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return errBufferClosed
+	}
+	select {
+	case b.queue <- req:
+	case <-ctx.Done():
+		b.mu.RUnlock()
+		return ctx.Err()
+	}
+	b.mu.RUnlock()
+	return <-req.result
+}
+
+// Collect queued creates into batches until close is called
+func (b *writeBuffer) run() {
+	defer close(b.done)
+	var batch []*bufferedCreate
+	timer := time.NewTimer(b.interval)
+	timer.Stop()
+	for {
+		select {
+		case req, ok := <-b.queue:
+			if !ok {
+				b.flush(batch)
+				return
+			}
+			if batch = append(batch, req); len(batch) == 1 {
+				timer.Reset(b.interval)
+			}
+			if len(batch) >= b.size {
+				timer.Stop()
+				b.flush(batch)
+				batch = nil
+			}
+		case <-timer.C:
+			b.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+// Stop accepting creates and wait for the last batch to be written.
+// Handlers still running after a timed-out shutdown get errBufferClosed.
+func (b *writeBuffer) close() {
+	b.mu.Lock()
+	b.closed = true
+	close(b.queue)
+	b.mu.Unlock()
+	<-b.done
+}
+
+// Insert a batch in one statement and report the outcome to every caller
+func (b *writeBuffer) flush(batch []*bufferedCreate) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx := context.Background()
+	err := runWrite(ctx, b.db, func(tx *sql.Tx) error {
+		values := make([]string, len(batch))
+		args := make([]interface{}, 0, 3*len(batch))
+		for i, req := range batch {
+			n := 3 * i
+			values[i] = "($" + strconv.Itoa(n+1) + ", $" + strconv.Itoa(n+2) + ", $" + strconv.Itoa(n+3) + ")"
+			args = append(args, req.u.F_name, req.u.L_name, pq.Array(req.u.Tags))
+		}
+		// RETURNING yields rows in VALUES order, which pairs them with callers
+		rows, err := tx.QueryContext(ctx, "INSERT INTO "+table+" (F_name, L_name, tags) VALUES "+
+			strings.Join(values, ", ")+" RETURNING "+selectList(userColumns), args...)
+		if err != nil {
+			return err
+		}
+		n := 0
+		for rows.Next() && n < len(batch) {
+			if err := rows.Scan(scanTargets(batch[n].u, userColumns)...); err != nil {
+				rows.Close()
+				return err
+			}
+			n++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if n != len(batch) {
+			return errors.New("buffered insert returned fewer rows than it wrote")
+		}
+
+		for _, req := range batch {
+			if err := enqueueEvent(ctx, tx, "create", *req.u); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Buffered insert of %d users failed: %v", len(batch), err)
+	}
+	for _, req := range batch {
+		req.result <- err
+	}
+}
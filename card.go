@@ -0,0 +1,63 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// cardTemplate is the HTML business card served by getCard.
+var cardTemplate = template.Must(template.New("card").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Name}}</title></head>
+<body>
+<div style="font-family: sans-serif; border: 1px solid #ccc; border-radius: 8px; padding: 16px; width: 320px">
+<h2 style="margin: 0 0 8px">{{.Name}}</h2>
+{{if .Tags}}<p style="margin: 0 0 8px; color: #555">{{.Tags}}</p>{{end}}
+<p style="margin: 0; color: #888; font-size: small">Since {{.Created}}</p>
+</div>
+</body>
+</html>
+`))
+
+// A printable summary of a human: an HTML card when the client accepts
+// text/html, plain text otherwise
+func getCard(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		var u User
+		err := runRead(r.Context(), func() error {
+			return db.QueryRowContext(r.Context(), "SELECT "+selectList(userColumns)+" FROM "+table+" WHERE id = $1", id).Scan(scanTargets(&u, userColumns)...)
+		})
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "User not found")
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to retrieve user")
+			return
+		}
+
+		card := struct{ Name, Tags, Created string }{
+			Name:    userFields["full_name"].value(u).(string),
+			Tags:    strings.Join(u.Tags, ", "),
+			Created: u.CreatedAt.UTC().Format("2006-01-02"),
+		}
+		w.Header().Add("Vary", "Accept")
+		if strings.Contains(r.Header.Get("Accept"), "text/html") {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			cardTemplate.Execute(w, card)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, card.Name)
+		if card.Tags != "" {
+			fmt.Fprintln(w, card.Tags)
+		}
+		fmt.Fprintln(w, "Since", card.Created)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Return what changed after ?since=: the users created or updated since
+// then and, when the outbox is recording events, the ids deleted since.
+// next_since is the cursor for the following call. It is the snapshot's
+// own time, so a write that was still committing then may carry an
+// earlier updated_at; clients wanting to be safe can overlap a little.
+func getChanges(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		param := r.URL.Query().Get("since")
+		if param == "" {
+			writeError(w, http.StatusBadRequest, "since is required")
+			return
+		}
+		since, err := parseDateParam(param)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "since: "+err.Error())
+			return
+		}
+
+		// One snapshot covers the changes, the deletions and the cursor
+		ctx := r.Context()
+		tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to retrieve changes")
+			return
+		}
+		defer tx.Rollback()
+
+		var now time.Time
+		if err := tx.QueryRowContext(ctx, "SELECT now()").Scan(&now); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to retrieve changes")
+			return
+		}
+
+		rows, err := tx.QueryContext(ctx, "SELECT "+selectList(userColumns)+" FROM "+table+
+			" WHERE updated_at > $1 ORDER BY updated_at, id", since)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to retrieve changes")
+			return
+		}
+		defer rows.Close()
+		changed := []User{}
+		for rows.Next() {
+			var u User
+			if err := rows.Scan(scanTargets(&u, userColumns)...); err != nil {
+				log.Println("getChanges: error scanning user:", err)
+				writeError(w, http.StatusInternalServerError, "Error scanning user")
+				return
+			}
+			changed = append(changed, u)
+		}
+		if err := rows.Err(); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to retrieve changes")
+			return
+		}
+
+		response := map[string]interface{}{
+			"changed":    changed,
+			"next_since": Timestamp{now},
+		}
+		if outboxEnabled {
+			deleted, err := deletedSince(ctx, tx, since)
+			if err != nil {
+				log.Println("getChanges: error reading deletions:", err)
+				writeError(w, http.StatusInternalServerError, "Failed to retrieve changes")
+				return
+			}
+			response["deleted"] = deleted
+		}
+		writeJSON(w, http.StatusOK, response)
+	}
+}
+
+// Ids deleted after since, read from the delete events in the outbox.
+// Ids come from a sequence and are never reused, so each stays deleted.
+func deletedSince(ctx context.Context, tx *sql.Tx, since time.Time) ([]UserID, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT DISTINCT (payload->'record'->>'id')::int FROM events_outbox "+
+		"WHERE table_name = $1 AND payload->>'operation' = 'delete' AND created_at > $2", table, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deleted := []UserID{}
+	for rows.Next() {
+		var id UserID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, id)
+	}
+	return deleted, rows.Err()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Pick the response encoding from Accept-Encoding, preferring br over
+// gzip. Returns "" when the client accepts neither.
+func negotiateEncoding(header string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, p := range fields[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[name] = q > 0
+	}
+	switch {
+	case accepted["br"]:
+		return "br"
+	case accepted["gzip"]:
+		return "gzip"
+	}
+	return ""
+}
+
+// Decompress gzip request bodies before handlers decode them, refusing
+// other encodings with 415. The inflated body is capped at limit bytes
+// so a small upload cannot expand without bound.
+func requestEncodingMiddleware(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+			case "", "identity":
+			case "gzip":
+				zr, err := gzip.NewReader(r.Body)
+				if err != nil {
+					w.Header().Set("Content-Type", "application/json")
+					writeError(w, http.StatusBadRequest, "Request body is not valid gzip")
+					return
+				}
+				defer zr.Close()
+				r.Body = http.MaxBytesReader(w, zr, limit)
+				r.Header.Del("Content-Encoding")
+				r.Header.Del("Content-Length")
+				r.ContentLength = -1
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				writeError(w, http.StatusUnsupportedMediaType, "Content-Encoding must be gzip or identity")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Compress responses of at least minSize bytes with br or gzip
+func compressMiddleware(minSize int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+			if encoding == "" || r.Method == "HEAD" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize, status: http.StatusOK}
+			defer cw.Close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// compressWriter buffers the start of a response until it knows whether
+// the body is large enough to be worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status      int
+	wroteHeader bool
+	decided     bool
+	buf         bytes.Buffer
+	enc         io.WriteCloser
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if !c.wroteHeader {
+		c.status = status
+		c.wroteHeader = true
+	}
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if c.decided {
+		if c.enc != nil {
+			return c.enc.Write(p)
+		}
+		return c.ResponseWriter.Write(p)
+	}
+	c.buf.Write(p)
+	if c.buf.Len() >= c.minSize {
+		if err := c.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Commit to compressing or not, then send the status and buffered bytes
+func (c *compressWriter) decide(compress bool) error {
+	c.decided = true
+	h := c.ResponseWriter.Header()
+	if h.Get("Content-Encoding") != "" || c.status == http.StatusNoContent || c.status == http.StatusNotModified {
+		compress = false
+	}
+	if compress {
+		h.Set("Content-Encoding", c.encoding)
+		h.Del("Content-Length")
+		if c.encoding == "br" {
+			c.enc = brotli.NewWriter(c.ResponseWriter)
+		} else {
+			c.enc = gzip.NewWriter(c.ResponseWriter)
+		}
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+
+	if c.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if c.enc != nil {
+		_, err = c.enc.Write(c.buf.Bytes())
+	} else {
+		_, err = c.ResponseWriter.Write(c.buf.Bytes())
+	}
+	c.buf.Reset()
+	return err
+}
+
+// Flush pushes out what has been written so far. A streaming response
+// is compressed from the first flush on, whatever its size.
+func (c *compressWriter) Flush() {
+	if !c.decided {
+		c.decide(true)
+	}
+	if f, ok := c.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the response, sending small bodies uncompressed
+func (c *compressWriter) Close() {
+	if !c.decided {
+		c.decide(false)
+	}
+	if c.enc != nil {
+		c.enc.Close()
+	}
+}
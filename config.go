@@ -0,0 +1,434 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds every setting the server reads from the environment.
+type Config struct {
+	Port         string
+	ListenSocket string
+	DatabaseURL  string
+	DBPassword   string
+	TableName    string
+	AdminAPIKey  string
+	DBSSLMode    string
+	CORSOrigins  []string
+	LogLevel     string
+
+	// BlockedUserAgents are User-Agent substrings answered with 403
+	BlockedUserAgents []string
+
+	// Requests per minute per client IP, and per partner API key
+	RateLimitPerMinute int
+	RateLimitKeys      map[string]int
+
+	SlowRequestThreshold time.Duration
+	ShutdownTimeout      time.Duration
+	MaxURLLength         int
+	MaxResponseBytes     int
+	Compression          bool
+	CompressMinBytes     int
+	MaxDecompressedBytes int
+
+	DBMaxOpenConns int
+	DBMaxIdleConns int
+
+	// StatementTimeout is the server-side statement_timeout per connection
+	StatementTimeout time.Duration
+
+	HealthCheckInterval    time.Duration
+	HealthCheckTimeout     time.Duration
+	HealthCheckMaxFailures int
+
+	LogDBStats      bool
+	DBStatsInterval time.Duration
+
+	ViewFlushInterval  time.Duration
+	WriteRetryAttempts int
+	ReadRetryAttempts  int
+	MaxBatchSize       int
+
+	BufferBatchSize     int
+	BufferFlushInterval time.Duration
+
+	MaxTags      int
+	MaxTagLength int
+
+	NameMaxLength int
+	NamePattern   string
+	ControlChars  string
+
+	SearchMaxResults int
+	ListWarnResults  int
+	ListCacheMaxAge  time.Duration
+	CacheJitter      bool
+
+	WebhookURL         string
+	OutboxWebhookURL   string
+	OutboxPollInterval time.Duration
+
+	// Feature flags
+	ReadOnly         bool
+	DisabledMethods  map[string]bool
+	AutoCreateSchema bool
+	NotFoundHints    bool
+	ResponseEnvelope bool
+	ForceHTTPS       bool
+	IDAsString       bool
+	JSONFieldStyle   string
+	JSONEscapeHTML   bool
+	BufferedWrites   bool
+
+	MaintenanceMode       bool
+	MaintenanceRetryAfter time.Duration
+
+	// invalid collects malformed settings for validate to report
+	invalid []string
+}
+
+// Load the configuration from the environment, applying defaults
+func loadConfig() Config {
+	// Secrets may instead be read from the file named by <KEY>_FILE, as
+	// Docker and Kubernetes mount them; the variable itself wins
+	var invalid []string
+	secret := func(key string) string {
+		v, err := envSecret(key)
+		if err != nil {
+			invalid = append(invalid, err.Error())
+		}
+		return v
+	}
+
+	cfg := Config{
+		Port:         envString("PORT", "8000"),
+		ListenSocket: os.Getenv("LISTEN_SOCKET"),
+		DatabaseURL:  secret("DATABASE_URL"),
+		DBPassword:   secret("DB_PASSWORD"),
+		TableName:    envString("TABLE_NAME", "humans"),
+		AdminAPIKey:  secret("ADMIN_API_KEY"),
+		DBSSLMode:    envString("DB_SSLMODE", os.Getenv("PGSSLMODE")),
+		CORSOrigins:  envList("CORS_ORIGINS", []string{"*"}),
+		LogLevel:     strings.ToLower(envString("LOG_LEVEL", "info")),
+
+		BlockedUserAgents: envList("BLOCKED_USER_AGENTS", nil),
+
+		RateLimitPerMinute: envInt("RATE_LIMIT_PER_MINUTE", 0),
+		RateLimitKeys:      map[string]int{},
+
+		SlowRequestThreshold: time.Duration(envInt("SLOW_REQUEST_MS", 500)) * time.Millisecond,
+		ShutdownTimeout:      time.Duration(envInt("SHUTDOWN_TIMEOUT_SECONDS", 10)) * time.Second,
+		MaxURLLength:         envInt("MAX_URL_LENGTH", 2048),
+		MaxResponseBytes:     envInt("MAX_RESPONSE_BYTES", 0),
+		Compression:          envBool("COMPRESSION", true),
+		CompressMinBytes:     envInt("COMPRESS_MIN_BYTES", 1024),
+		MaxDecompressedBytes: envInt("MAX_DECOMPRESSED_BYTES", 10<<20),
+
+		DBMaxOpenConns: envInt("DB_MAX_OPEN_CONNS", 0),
+		DBMaxIdleConns: envInt("DB_MAX_IDLE_CONNS", 2),
+
+		StatementTimeout: time.Duration(envInt("STATEMENT_TIMEOUT_MS", 5000)) * time.Millisecond,
+
+		HealthCheckInterval:    time.Duration(envInt("HEALTHCHECK_INTERVAL_SECONDS", 10)) * time.Second,
+		HealthCheckTimeout:     time.Duration(envInt("HEALTHCHECK_TIMEOUT_MS", 2000)) * time.Millisecond,
+		HealthCheckMaxFailures: envInt("HEALTHCHECK_MAX_FAILURES", 3),
+
+		LogDBStats:      envBool("LOG_DB_STATS", false),
+		DBStatsInterval: time.Duration(envInt("DB_STATS_INTERVAL_SECONDS", 60)) * time.Second,
+
+		ViewFlushInterval:  time.Duration(envInt("VIEW_FLUSH_SECONDS", 5)) * time.Second,
+		WriteRetryAttempts: envInt("WRITE_RETRY_ATTEMPTS", 3),
+		ReadRetryAttempts:  envInt("READ_RETRY_ATTEMPTS", 2),
+		MaxBatchSize:       envInt("MAX_BATCH_SIZE", 500),
+
+		BufferBatchSize:     envInt("BUFFER_BATCH_SIZE", 100),
+		BufferFlushInterval: time.Duration(envInt("BUFFER_FLUSH_MS", 10)) * time.Millisecond,
+
+		MaxTags:      envInt("MAX_TAGS", 20),
+		MaxTagLength: envInt("MAX_TAG_LENGTH", 50),
+
+		NameMaxLength: envInt("NAME_MAX_LENGTH", 100),
+		NamePattern:   envString("NAME_PATTERN", defaultNamePattern),
+		ControlChars:  strings.ToLower(envString("CONTROL_CHARS", "reject")),
+
+		SearchMaxResults: envInt("SEARCH_MAX_RESULTS", 100),
+		ListWarnResults:  envInt("LIST_WARN_RESULTS", 1000),
+		ListCacheMaxAge:  time.Duration(envInt("LIST_CACHE_SECONDS", 0)) * time.Second,
+		CacheJitter:      envBool("CACHE_JITTER", true),
+
+		WebhookURL:         secret("WEBHOOK_URL"),
+		OutboxWebhookURL:   secret("OUTBOX_WEBHOOK_URL"),
+		OutboxPollInterval: time.Duration(envInt("OUTBOX_POLL_SECONDS", 5)) * time.Second,
+
+		ReadOnly:         envBool("READONLY", false),
+		DisabledMethods:  map[string]bool{},
+		AutoCreateSchema: envBool("AUTO_CREATE_SCHEMA", true),
+		NotFoundHints:    envBool("NOT_FOUND_HINTS", false),
+		ResponseEnvelope: envBool("RESPONSE_ENVELOPE", false),
+		ForceHTTPS:       envBool("FORCE_HTTPS", false),
+		IDAsString:       envBool("ID_AS_STRING", false),
+		JSONFieldStyle:   strings.ToLower(envString("JSON_FIELD_STYLE", "legacy")),
+		JSONEscapeHTML:   envBool("JSON_ESCAPE_HTML", true),
+		BufferedWrites:   envBool("BUFFERED_WRITES", false),
+
+		MaintenanceMode:       envBool("MAINTENANCE_MODE", false),
+		MaintenanceRetryAfter: time.Duration(envInt("MAINTENANCE_RETRY_AFTER_SECONDS", 60)) * time.Second,
+	}
+	// Only now have the secret calls above all run
+	cfg.invalid = append(cfg.invalid, invalid...)
+
+	// DISABLED_METHODS takes a comma-separated list such as "PUT,DELETE"
+	for _, m := range envList("DISABLED_METHODS", nil) {
+		cfg.DisabledMethods[strings.ToUpper(m)] = true
+	}
+
+	// RATE_LIMIT_KEYS lists partner keys with their limits, "key:limit,..."
+	for _, pair := range envList("RATE_LIMIT_KEYS", nil) {
+		i := strings.LastIndex(pair, ":")
+		if i <= 0 {
+			cfg.invalid = append(cfg.invalid, "RATE_LIMIT_KEYS entries must be key:limit")
+			continue
+		}
+		n, err := strconv.Atoi(pair[i+1:])
+		if err != nil || n <= 0 {
+			cfg.invalid = append(cfg.invalid, "RATE_LIMIT_KEYS limits must be positive integers")
+			continue
+		}
+		cfg.RateLimitKeys[pair[:i]] = n
+	}
+	return cfg
+}
+
+// String renders the effective configuration on one line with secrets masked
+func (c Config) String() string {
+	disabled := make([]string, 0, len(c.DisabledMethods))
+	for m := range c.DisabledMethods {
+		disabled = append(disabled, m)
+	}
+	sort.Strings(disabled)
+
+	fields := []string{
+		"port=" + c.Port,
+		"listen_socket=" + c.ListenSocket,
+		fmt.Sprintf("database_url=%q", maskDSN(c.DatabaseURL)),
+		"db_password=" + maskSecret(c.DBPassword),
+		"table_name=" + c.TableName,
+		"db_sslmode=" + c.DBSSLMode,
+		fmt.Sprintf("statement_timeout=%s", c.StatementTimeout),
+		"admin_api_key=" + maskSecret(c.AdminAPIKey),
+		fmt.Sprintf("cors_origins=%v", c.CORSOrigins),
+		"log_level=" + c.LogLevel,
+		fmt.Sprintf("blocked_user_agents=%q", c.BlockedUserAgents),
+		fmt.Sprintf("rate_limit_per_minute=%d", c.RateLimitPerMinute),
+		fmt.Sprintf("rate_limit_keys=%d", len(c.RateLimitKeys)),
+		fmt.Sprintf("slow_request_threshold=%s", c.SlowRequestThreshold),
+		fmt.Sprintf("shutdown_timeout=%s", c.ShutdownTimeout),
+		fmt.Sprintf("max_url_length=%d", c.MaxURLLength),
+		fmt.Sprintf("max_response_bytes=%d", c.MaxResponseBytes),
+		fmt.Sprintf("compression=%t", c.Compression),
+		fmt.Sprintf("compress_min_bytes=%d", c.CompressMinBytes),
+		fmt.Sprintf("max_decompressed_bytes=%d", c.MaxDecompressedBytes),
+		fmt.Sprintf("db_max_open_conns=%d", c.DBMaxOpenConns),
+		fmt.Sprintf("db_max_idle_conns=%d", c.DBMaxIdleConns),
+		fmt.Sprintf("healthcheck_interval=%s", c.HealthCheckInterval),
+		fmt.Sprintf("healthcheck_timeout=%s", c.HealthCheckTimeout),
+		fmt.Sprintf("healthcheck_max_failures=%d", c.HealthCheckMaxFailures),
+		fmt.Sprintf("log_db_stats=%t", c.LogDBStats),
+		fmt.Sprintf("db_stats_interval=%s", c.DBStatsInterval),
+		fmt.Sprintf("view_flush_interval=%s", c.ViewFlushInterval),
+		fmt.Sprintf("write_retry_attempts=%d", c.WriteRetryAttempts),
+		fmt.Sprintf("read_retry_attempts=%d", c.ReadRetryAttempts),
+		fmt.Sprintf("max_batch_size=%d", c.MaxBatchSize),
+		fmt.Sprintf("buffer_batch_size=%d", c.BufferBatchSize),
+		fmt.Sprintf("buffer_flush_interval=%s", c.BufferFlushInterval),
+		fmt.Sprintf("max_tags=%d", c.MaxTags),
+		fmt.Sprintf("max_tag_length=%d", c.MaxTagLength),
+		fmt.Sprintf("name_max_length=%d", c.NameMaxLength),
+		fmt.Sprintf("name_pattern=%q", c.NamePattern),
+		"control_chars=" + c.ControlChars,
+		fmt.Sprintf("search_max_results=%d", c.SearchMaxResults),
+		fmt.Sprintf("list_warn_results=%d", c.ListWarnResults),
+		fmt.Sprintf("list_cache_max_age=%s", c.ListCacheMaxAge),
+		fmt.Sprintf("cache_jitter=%t", c.CacheJitter),
+		"webhook_url=" + maskURL(c.WebhookURL),
+		"outbox_webhook_url=" + maskURL(c.OutboxWebhookURL),
+		fmt.Sprintf("outbox_poll_interval=%s", c.OutboxPollInterval),
+		fmt.Sprintf("readonly=%t", c.ReadOnly),
+		fmt.Sprintf("disabled_methods=%v", disabled),
+		fmt.Sprintf("auto_create_schema=%t", c.AutoCreateSchema),
+		fmt.Sprintf("not_found_hints=%t", c.NotFoundHints),
+		fmt.Sprintf("response_envelope=%t", c.ResponseEnvelope),
+		fmt.Sprintf("force_https=%t", c.ForceHTTPS),
+		fmt.Sprintf("id_as_string=%t", c.IDAsString),
+		"json_field_style=" + c.JSONFieldStyle,
+		fmt.Sprintf("json_escape_html=%t", c.JSONEscapeHTML),
+		fmt.Sprintf("buffered_writes=%t", c.BufferedWrites),
+		fmt.Sprintf("maintenance_mode=%t", c.MaintenanceMode),
+		fmt.Sprintf("maintenance_retry_after=%s", c.MaintenanceRetryAfter),
+	}
+	return strings.Join(fields, " ")
+}
+
+var tableNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// Reject settings that would be unsafe or meaningless to run with
+func (c Config) validate() error {
+	if len(c.invalid) > 0 {
+		return errors.New(c.invalid[0])
+	}
+	if !tableNamePattern.MatchString(c.TableName) {
+		return fmt.Errorf("TABLE_NAME %q must be a lowercase SQL identifier", c.TableName)
+	}
+	if _, ok := jsonFieldStyles[c.JSONFieldStyle]; !ok {
+		return fmt.Errorf("JSON_FIELD_STYLE %q must be legacy, snake or camel", c.JSONFieldStyle)
+	}
+	if _, err := regexp.Compile(c.NamePattern); err != nil {
+		return fmt.Errorf("NAME_PATTERN: %v", err)
+	}
+	if c.ControlChars != "reject" && c.ControlChars != "strip" {
+		return fmt.Errorf("CONTROL_CHARS %q must be reject or strip", c.ControlChars)
+	}
+	// Each buffered row takes three of Postgres's 65535 bind parameters
+	if c.BufferBatchSize > 65535/3 {
+		return fmt.Errorf("BUFFER_BATCH_SIZE %d is above the %d rows one INSERT can bind", c.BufferBatchSize, 65535/3)
+	}
+	if c.DBSSLMode != "" && !sslModes[c.DBSSLMode] {
+		return fmt.Errorf("DB_SSLMODE %q is not supported by the driver", c.DBSSLMode)
+	}
+	return nil
+}
+
+// sslModes are the values lib/pq accepts; it has no "prefer" or "allow".
+var sslModes = map[string]bool{"disable": true, "require": true, "verify-ca": true, "verify-full": true}
+
+// Add key=def to a URL or key=value DSN unless it already sets key.
+// Returns the DSN and the value that will take effect.
+func applyDSNDefault(dsn, key, def string) (string, string) {
+	if v := dsnValue(dsn, key); v != "" {
+		return dsn, v
+	}
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		q := u.Query()
+		q.Set(key, def)
+		u.RawQuery = q.Encode()
+		return u.String(), def
+	}
+	return strings.TrimSpace(dsn + " " + key + "=" + def), def
+}
+
+// Value of key in a URL or key=value DSN, or "" when it has none
+func dsnValue(dsn, key string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		return u.Query().Get(key)
+	}
+	pattern := regexp.MustCompile(`(^|\s)` + regexp.QuoteMeta(key) + `=('[^']*'|\S+)`)
+	if m := pattern.FindStringSubmatch(dsn); m != nil {
+		return strings.Trim(m[2], "'")
+	}
+	return ""
+}
+
+// Report only whether a secret is set, never its value
+func maskSecret(s string) string {
+	if s == "" {
+		return "unset"
+	}
+	return "xxxxx"
+}
+
+// Show only the scheme and host of a URL that may carry a token in its
+// path or query, as Slack and Discord webhook URLs do
+func maskURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return maskSecret(s)
+	}
+	return u.Scheme + "://" + u.Host + "/xxxxx"
+}
+
+// Set the password in a URL or key=value DSN, replacing any it has
+func applyPassword(dsn, password string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		u.User = url.UserPassword(u.User.Username(), password)
+		return u.String()
+	}
+	// Later keys win in lib/pq, so appending overrides an existing password
+	quoted := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(password)
+	return strings.TrimSpace(dsn + " password='" + quoted + "'")
+}
+
+var dsnPassword = regexp.MustCompile(`password=('[^']*'|\S+)`)
+
+// Hide the password in either a URL or a key=value connection string
+func maskDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+		}
+		q := u.Query()
+		if q.Get("password") != "" {
+			q.Set("password", "xxxxx")
+			u.RawQuery = q.Encode()
+		}
+		return u.String()
+	}
+	return dsnPassword.ReplaceAllString(dsn, "password=xxxxx")
+}
+
+// Read a secret from key, or else from the file named by key_FILE with
+// surrounding whitespace trimmed
+func envSecret(key string) (string, error) {
+	if v := os.Getenv(key); v != "" {
+		return v, nil
+	}
+	path := os.Getenv(key + "_FILE")
+	if path == "" {
+		return "", nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%s_FILE: %v", key, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// Read a positive integer from the environment, falling back to def
+func envInt(key string, def int) int {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
+
+func envBool(key string, def bool) bool {
+	b, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// Read a comma-separated list from the environment, dropping empty items
+func envList(key string, def []string) []string {
+	if list := splitList(os.Getenv(key)); len(list) > 0 {
+		return list
+	}
+	return def
+}
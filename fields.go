@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// userColumns are the stored columns selected when no ?fields= is given.
+var userColumns = []string{"id", "F_name", "L_name", "view_count", "tags", "active", "created_at", "updated_at"}
+
+// fieldDef describes a field clients may ask for with ?fields=. Stored
+// fields read their own column; computed fields list the columns they
+// are derived from so the query can fetch them transparently.
+// There is no computed age: the table stores no birth date to derive
+// it from.
+type fieldDef struct {
+	columns []string
+	value   func(u User) interface{}
+}
+
+var userFields = map[string]fieldDef{
+	"id":         {[]string{"id"}, func(u User) interface{} { return u.ID }},
+	"F_name":     {[]string{"F_name"}, func(u User) interface{} { return u.F_name }},
+	"L_name":     {[]string{"L_name"}, func(u User) interface{} { return u.L_name }},
+	"view_count": {[]string{"view_count"}, func(u User) interface{} { return u.ViewCount }},
+	"tags":       {[]string{"tags"}, func(u User) interface{} { return u.Tags }},
+	"active":     {[]string{"active"}, func(u User) interface{} { return u.Active }},
+	"created_at": {[]string{"created_at"}, func(u User) interface{} { return u.CreatedAt }},
+	"updated_at": {[]string{"updated_at"}, func(u User) interface{} { return u.UpdatedAt }},
+	"full_name": {[]string{"F_name", "L_name"}, func(u User) interface{} {
+		if u.L_name == nil {
+			return u.F_name
+		}
+		return strings.TrimSpace(u.F_name + " " + *u.L_name)
+	}},
+}
+
+// Parse a comma-separated ?fields= value, rejecting unknown names.
+// An empty value returns nil, meaning the full record.
+func parseFields(param string) ([]string, error) {
+	var fields []string
+	for _, name := range strings.Split(param, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		f := internalName(name)
+		if _, ok := userFields[f]; !ok {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// Comma-separated column list for a SELECT
+func selectList(columns []string) string {
+	return strings.Join(columns, ", ")
+}
+
+// Columns needed to produce the requested fields, without duplicates
+func fieldColumns(fields []string) []string {
+	if fields == nil {
+		return userColumns
+	}
+	seen := map[string]bool{}
+	var columns []string
+	for _, f := range fields {
+		for _, c := range userFields[f].columns {
+			if !seen[c] {
+				seen[c] = true
+				columns = append(columns, c)
+			}
+		}
+	}
+	return columns
+}
+
+// Scan destinations in u for the given columns
+func scanTargets(u *User, columns []string) []interface{} {
+	targets := make([]interface{}, len(columns))
+	for i, c := range columns {
+		switch c {
+		case "id":
+			targets[i] = &u.ID
+		case "F_name":
+			targets[i] = &u.F_name
+		case "L_name":
+			targets[i] = &u.L_name
+		case "view_count":
+			targets[i] = &u.ViewCount
+		case "tags":
+			targets[i] = pq.Array(&u.Tags)
+		case "active":
+			targets[i] = &u.Active
+		case "created_at":
+			targets[i] = &u.CreatedAt
+		case "updated_at":
+			targets[i] = &u.UpdatedAt
+		}
+	}
+	return targets
+}
+
+// Build the partial representation of u holding only the requested fields
+func projectUser(u User, fields []string) map[string]interface{} {
+	out := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		out[wireName(f)] = userFields[f].value(u)
+	}
+	return out
+}
+
+// scoredUser is a search result: the user plus its similarity score.
+type scoredUser struct {
+	User
+	Score float64 `json:"score"`
+}
+
+// scanError is a row that could not be scanned into a User, most likely
+// because the table's columns no longer match the model. The driver's
+// message names the failing column.
+type scanError struct {
+	columns []string
+	err     error
+}
+
+func (e *scanError) Error() string {
+	return fmt.Sprintf("scanning %s: %v", selectList(e.columns), e.err)
+}
+
+// Return a function that scans one list row into what the client asked
+// for: the full user or its requested fields, with a score when searching
+func listRowDecoder(columns, fields []string, scored bool) func(rows *sql.Rows) (interface{}, error) {
+	return func(rows *sql.Rows) (interface{}, error) {
+		var u User
+		var score float64
+		targets := scanTargets(&u, columns)
+		if scored {
+			targets = append(targets, &score)
+		}
+		if err := rows.Scan(targets...); err != nil {
+			return nil, &scanError{columns, err}
+		}
+
+		switch {
+		case fields != nil:
+			out := projectUser(u, fields)
+			if scored {
+				out["score"] = score
+			}
+			return out, nil
+		case scored:
+			return scoredUser{u, score}, nil
+		}
+		return u, nil
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// nameExpr is the full name as the trigram index and search see it.
+// It must stay identical to the indexed expression in ensureSchema.
+const nameExpr = "(F_name || ' ' || COALESCE(L_name, ''))"
+
+// searchMaxResults caps every search response; set from SEARCH_MAX_RESULTS.
+var searchMaxResults = 100
+
+// listWarnResults is the size above which a plain list is logged and
+// flagged so non-paginating clients can be found; set from
+// LIST_WARN_RESULTS. Plain lists are never cut short.
+var listWarnResults = 1000
+
+// listQuery is the filtered, ordered SELECT behind the user list.
+type listQuery struct {
+	conds   []string
+	args    []interface{}
+	orderBy []string
+
+	// max is the most rows returned, or 0 for all of them; limit fetches
+	// one more so a cut-off result can be detected
+	max   int
+	limit int
+
+	// score is the similarity expression when a ?q= search is active
+	score string
+
+	// collation is the ICU collation the names sort by with ?locale=
+	collation string
+}
+
+// Add a query argument and return its placeholder
+func (q *listQuery) arg(v interface{}) string {
+	q.args = append(q.args, v)
+	return "$" + strconv.Itoa(len(q.args))
+}
+
+// Build the list query from the request's filter parameters
+func parseListQuery(r *http.Request) (*listQuery, error) {
+	return parseListParams(r.URL.Query())
+}
+
+// Build the list query from filter parameters in the form of a URL query
+func parseListParams(params url.Values) (*listQuery, error) {
+	q := &listQuery{}
+
+	if tag := params.Get("tag"); tag != "" {
+		// Written as containment so the GIN index on tags applies
+		q.conds = append(q.conds, "tags @> ARRAY["+q.arg(tag)+"::text]")
+	}
+	if tags := splitList(params.Get("tags")); len(tags) > 0 {
+		switch params.Get("match") {
+		case "", "any":
+			q.conds = append(q.conds, "tags && "+q.arg(pq.Array(tags)))
+		case "all":
+			q.conds = append(q.conds, "tags @> "+q.arg(pq.Array(tags)))
+		default:
+			return nil, fmt.Errorf("match must be \"any\" or \"all\"")
+		}
+	}
+
+	if active := params.Get("active"); active != "" {
+		b, err := strconv.ParseBool(active)
+		if err != nil {
+			return nil, fmt.Errorf("active must be true or false")
+		}
+		q.conds = append(q.conds, "active = "+q.arg(b))
+	}
+
+	// Creation date range; either bound may be left open
+	for _, bound := range []struct{ param, op string }{{"created_after", ">="}, {"created_before", "<"}} {
+		if v := params.Get(bound.param); v != "" {
+			t, err := parseDateParam(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", bound.param, err)
+			}
+			q.conds = append(q.conds, "created_at "+bound.op+" "+q.arg(t))
+		}
+	}
+
+	// Fuzzy name search: % matches through the trigram index, and the
+	// closest matches come first
+	if search := strings.TrimSpace(params.Get("q")); search != "" {
+		p := q.arg(search)
+		q.score = "similarity(" + nameExpr + ", " + p + ")"
+		q.conds = append(q.conds, nameExpr+" % "+p)
+		q.orderBy = append(q.orderBy, q.score+" DESC")
+		q.max = searchMaxResults
+	}
+
+	// An explicit ?sort= takes precedence over search ranking
+	if sort := params.Get("sort"); sort != "" {
+		orderBy, err := parseSort(sort)
+		if err != nil {
+			return nil, err
+		}
+		q.orderBy = orderBy
+	}
+
+	// ?locale= sorts names by that language's rules; the collation is
+	// checked against the database by checkCollation
+	if locale := params.Get("locale"); locale != "" {
+		if !localePattern.MatchString(locale) {
+			return nil, fmt.Errorf("locale: invalid locale %q", locale)
+		}
+		q.collation = locale + "-x-icu"
+		for i, term := range q.orderBy {
+			parts := strings.Split(term, " ")
+			if parts[0] == "F_name" || parts[0] == "L_name" {
+				q.orderBy[i] = parts[0] + ` COLLATE "` + q.collation + `" ` + parts[1]
+			}
+		}
+	}
+
+	q.orderBy = append(q.orderBy, "id")
+	if q.max > 0 {
+		q.limit = q.max + 1
+	}
+	return q, nil
+}
+
+// Parse a YYYY-MM-DD date, taken as midnight UTC, or an RFC 3339 timestamp
+func parseDateParam(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	if t, err := parseTimestamp(s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or RFC 3339", s)
+}
+
+// sortColumns are the columns the list may be ordered by.
+var sortColumns = []string{"id", "F_name", "L_name", "view_count", "created_at", "updated_at"}
+
+// Parse ?sort=field[:asc|desc],... into ORDER BY terms. The direction
+// defaults to asc.
+func parseSort(param string) ([]string, error) {
+	var orderBy []string
+	for _, pair := range strings.Split(param, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), ":")
+		parts[0] = internalName(parts[0])
+		if len(parts) > 2 || !contains(sortColumns, parts[0]) {
+			return nil, fmt.Errorf("sort: invalid field %q", pair)
+		}
+		dir := "ASC"
+		if len(parts) == 2 {
+			switch strings.ToLower(parts[1]) {
+			case "asc":
+			case "desc":
+				dir = "DESC"
+			default:
+				return nil, fmt.Errorf("sort: direction in %q must be asc or desc", pair)
+			}
+		}
+		orderBy = append(orderBy, parts[0]+" "+dir)
+	}
+	return orderBy, nil
+}
+
+// localePattern matches BCP 47 tags such as de, de-AT or zh-Hant.
+var localePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// installedCollations caches the ICU collations found in pg_collation.
+var installedCollations sync.Map
+
+// Report whether the ?locale= collation, if any, is installed
+func (q *listQuery) checkCollation(ctx context.Context, db *sql.DB) (bool, error) {
+	if q.collation == "" {
+		return true, nil
+	}
+	if _, ok := installedCollations.Load(q.collation); ok {
+		return true, nil
+	}
+	var exists bool
+	err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_collation WHERE collname = $1)", q.collation).Scan(&exists)
+	if exists {
+		installedCollations.Store(q.collation, true)
+	}
+	return exists, err
+}
+
+// SQL selecting columns, plus a similarity score when searching
+func (q *listQuery) selectSQL(columns []string) string {
+	sql := "SELECT " + selectList(columns)
+	if q.score != "" {
+		sql += ", " + q.score + " AS score"
+	}
+	sql += " FROM " + table
+	if len(q.conds) > 0 {
+		sql += " WHERE " + strings.Join(q.conds, " AND ")
+	}
+	sql += " ORDER BY " + strings.Join(q.orderBy, ", ")
+	if q.limit > 0 {
+		sql += " LIMIT " + strconv.Itoa(q.limit)
+	}
+	return sql
+}
+
+// Split a comma-separated query value, dropping empty items
+func splitList(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
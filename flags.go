@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// flag is a boolean that can be flipped at runtime from /admin/flags.
+type flag int32
+
+func (f *flag) on() bool {
+	return atomic.LoadInt32((*int32)(f)) != 0
+}
+
+func (f *flag) set(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32((*int32)(f), v)
+}
+
+// runtimeFlags are the flags operators may change without a restart. They
+// start from the environment and changes last until the process exits.
+var runtimeFlags = map[string]*flag{
+	"maintenance_mode": &maintenanceMode,
+	"readonly":         &readOnly,
+	"debug_logging":    &debugLogging,
+	"list_cache":       &listCache,
+}
+
+// Report the runtime flags or, on PUT, update those named in a body such
+// as {"readonly": true}; the flags not named keep their values
+func flagsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		var body map[string]bool
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "Body must be an object of flag names to true or false")
+			return
+		}
+		for name := range body {
+			if runtimeFlags[name] == nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("Unknown flag %q", name))
+				return
+			}
+		}
+		for name, on := range body {
+			runtimeFlags[name].set(on)
+			log.Printf("Flag %s set to %t", name, on)
+		}
+	}
+
+	current := make(map[string]bool, len(runtimeFlags))
+	for name, f := range runtimeFlags {
+		current[name] = f.on()
+	}
+	writeJSON(w, http.StatusOK, current)
+}
@@ -1,8 +1,13 @@
-module api
-
-go 1.17
-
-require (
-	github.com/gorilla/mux v1.8.1 // indirect
-	github.com/lib/pq v1.10.9 // indirect
-)
+module api
+
+go 1.17
+
+require (
+	github.com/andybalholm/brotli v1.1.0
+	github.com/gorilla/handlers v1.5.1
+	github.com/gorilla/mux v1.8.1
+	github.com/lib/pq v1.10.9
+	golang.org/x/sync v0.1.0
+)
+
+require github.com/felixge/httpsnoop v1.0.1 // indirect
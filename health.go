@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// dbHealth tracks whether the database has been answering pings.
+// It is flipped by watchDB and read by the /readyz handler.
+type dbHealth struct {
+	unhealthy int32
+}
+
+func (h *dbHealth) healthy() bool {
+	return atomic.LoadInt32(&h.unhealthy) == 0
+}
+
+// Ping the database every interval, giving up on a ping after timeout so
+// a wedged database counts as a failure rather than stalling the watcher.
+// After maxFailures consecutive failed pings the service is marked
+// unhealthy; the first successful ping marks it healthy again.
+func watchDB(db *sql.DB, h *dbHealth, interval, timeout time.Duration, maxFailures int) {
+	failures := 0
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := db.PingContext(ctx)
+		cancel()
+		if err != nil {
+			failures++
+			if failures >= maxFailures && atomic.CompareAndSwapInt32(&h.unhealthy, 0, 1) {
+				log.Printf("Database unhealthy after %d failed pings: %v", failures, err)
+			}
+			continue
+		}
+		failures = 0
+		if atomic.CompareAndSwapInt32(&h.unhealthy, 1, 0) {
+			log.Println("Database connection recovered")
+		}
+	}
+}
+
+// Log the connection pool's statistics every interval, to show pool
+// saturation and leaked connections over time
+func logDBStats(db *sql.DB, interval time.Duration) {
+	for range time.Tick(interval) {
+		s := db.Stats()
+		log.Printf("DB pool: open=%d in_use=%d idle=%d wait_count=%d wait_duration=%s max_idle_closed=%d max_lifetime_closed=%d",
+			s.OpenConnections, s.InUse, s.Idle, s.WaitCount, s.WaitDuration, s.MaxIdleClosed, s.MaxLifetimeClosed)
+	}
+}
+
+// Readiness handler
+func readyHandler(h *dbHealth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.healthy() {
+			writeError(w, http.StatusServiceUnavailable, "Database unavailable")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// idAsString makes ids encode as JSON strings when ID_AS_STRING=true, for
+// clients that would lose precision on integers past 2^53.
+var idAsString bool
+
+// UserID is a record id. It encodes as a number or, with idAsString, a
+// string, and decodes from either.
+type UserID int
+
+func (id UserID) MarshalJSON() ([]byte, error) {
+	s := strconv.Itoa(int(id))
+	if idAsString {
+		return []byte(`"` + s + `"`), nil
+	}
+	return []byte(s), nil
+}
+
+func (id *UserID) UnmarshalJSON(b []byte) error {
+	if bytes.Equal(b, []byte("null")) {
+		return nil
+	}
+	n, err := parseUserID(string(bytes.Trim(b, `"`)))
+	if err != nil {
+		return err
+	}
+	*id = n
+	return nil
+}
+
+var (
+	errInvalidID    = errors.New("id must be an integer")
+	errIDOutOfRange = errors.New("id out of range")
+)
+
+// Parse an id. The id column is a 32-bit SERIAL, so a larger value could
+// never match and is refused rather than left for Postgres to reject.
+func parseUserID(s string) (UserID, error) {
+	n, err := strconv.ParseInt(s, 10, 32)
+	if ne, ok := err.(*strconv.NumError); ok && ne.Err == strconv.ErrRange {
+		return 0, errIDOutOfRange
+	} else if err != nil {
+		return 0, errInvalidID
+	}
+	return UserID(n), nil
+}
+
+// Answer 400 for a route's {id} that is not a valid id, so no handler
+// sends it to the database
+func idParamMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := mux.Vars(r)["id"]; ok {
+			if _, err := parseUserID(id); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
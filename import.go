@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// importBatchSize is how many records each import transaction commits.
+	importBatchSize = 500
+	// importMaxErrors caps the rejected lines listed in the summary.
+	importMaxErrors = 100
+	// importMaxLine is the longest NDJSON line accepted, in bytes.
+	importMaxLine = 1 << 20
+)
+
+// importError reports a line that was not imported.
+type importError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// Import humans from an NDJSON body, one record per line, committing
+// every importBatchSize rows so memory stays flat however large the
+// body is. Nothing is written until the body has been read to the end:
+// Go's HTTP/1 server discards the unread body on the first write, which
+// would silently cut the import short. The reply is one summary object.
+// Invalid lines are skipped and reported; a body that can't be read to
+// the end fails the import after committing what came before.
+// Changes go to the outbox but not to WEBHOOK_URL, so a large import
+// does not fire a request per row.
+func importUsers(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-ndjson") {
+			writeError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/x-ndjson")
+			return
+		}
+		ctx := r.Context()
+
+		var batch []User
+		imported, failed, line := 0, 0, 0
+		errs := []importError{}
+		reject := func(msg string) {
+			failed++
+			if len(errs) < importMaxErrors {
+				errs = append(errs, importError{line, msg})
+			}
+		}
+		commit := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			err := runWrite(ctx, db, func(tx *sql.Tx) error {
+				stmt, err := tx.PrepareContext(ctx, "INSERT INTO "+table+" (F_name, L_name, tags) VALUES ($1, $2, $3) RETURNING "+selectList(userColumns))
+				if err != nil {
+					return err
+				}
+				defer stmt.Close()
+				for i := range batch {
+					u := &batch[i]
+					if err := stmt.QueryRowContext(ctx, u.F_name, u.L_name, pq.Array(u.Tags)).Scan(scanTargets(u, userColumns)...); err != nil {
+						return err
+					}
+					if err := enqueueEvent(ctx, tx, "create", *u); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			imported += len(batch)
+			batch = batch[:0]
+			return nil
+		}
+
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 64*1024), importMaxLine)
+		for scanner.Scan() {
+			line++
+			text := bytes.TrimSpace(scanner.Bytes())
+			if len(text) == 0 {
+				continue
+			}
+			var u User
+			if err := json.Unmarshal(text, &u); err != nil {
+				reject("Invalid JSON")
+				continue
+			}
+			if u.Tags == nil {
+				u.Tags = []string{}
+			}
+			if err := validateCreate(&u); err != nil {
+				reject(err.Error())
+				continue
+			}
+			if batch = append(batch, u); len(batch) == importBatchSize {
+				if err := commit(); err != nil {
+					importFailed(w, err, imported, line)
+					return
+				}
+			}
+		}
+		// A read error ends the body early, so whatever follows was never
+		// seen: keep what was read but don't report the import as done
+		if readErr := scanner.Err(); readErr != nil {
+			line++
+			if err := commit(); err != nil {
+				importFailed(w, err, imported, line)
+				return
+			}
+			importFailed(w, importReadError{readErr}, imported, line)
+			return
+		}
+		if err := commit(); err != nil {
+			importFailed(w, err, imported, line)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{"done": true, "imported": imported, "failed": failed, "errors": errs})
+	}
+}
+
+// importReadError is a failure reading the import body, as opposed to
+// storing it.
+type importReadError struct {
+	err error
+}
+
+func (e importReadError) Error() string {
+	return e.err.Error()
+}
+
+// Report an import stopped by a failed batch or an unreadable body, with
+// what was committed before it
+func importFailed(w http.ResponseWriter, err error, imported, line int) {
+	log.Printf("Import stopped at line %d: %v", line, err)
+	details := map[string]interface{}{"imported": imported, "line": line}
+	if readErr, ok := err.(importReadError); ok {
+		switch {
+		case readErr.err == bufio.ErrTooLong:
+			writeErrorDetails(w, http.StatusBadRequest, fmt.Sprintf("Line is longer than %d bytes", importMaxLine), details)
+		case isBodyTooLarge(readErr.err):
+			writeErrorDetails(w, http.StatusRequestEntityTooLarge, "Request body is too large", details)
+		default:
+			writeErrorDetails(w, http.StatusBadRequest, "Could not read the request body", details)
+		}
+		return
+	}
+	status := http.StatusInternalServerError
+	if err == errWriteContention {
+		w.Header().Set("Retry-After", "1")
+		status = http.StatusServiceUnavailable
+	}
+	writeErrorDetails(w, status, "Failed to import batch", details)
+}
+
+// Report whether err is http.MaxBytesReader's over-limit error. Go 1.17
+// has no exported type for it, only the message.
+func isBodyTooLarge(err error) bool {
+	return err != nil && err.Error() == "http: request body too large"
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Activate or deactivate a human, returning the updated record.
+// Deactivated humans stay readable and can be filtered with ?active=.
+func setActive(db *sql.DB, active bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		var u User
+		err := runWrite(r.Context(), db, func(tx *sql.Tx) error {
+			err := tx.QueryRowContext(r.Context(), "UPDATE "+table+" SET active = $1, updated_at = now() WHERE id = $2 RETURNING "+selectList(userColumns),
+				active, id).Scan(scanTargets(&u, userColumns)...)
+			if err != nil {
+				return err
+			}
+			return enqueueEvent(r.Context(), tx, "update", u)
+		})
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "User not found")
+			return
+		} else if err != nil {
+			writeWriteError(w, err, "Failed to update user")
+			return
+		}
+		notifyChange("update", u)
+
+		w.Header().Set("ETag", userETag(int(u.ID), u.UpdatedAt.Time))
+		writeJSON(w, http.StatusOK, u)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// statusRecorder remembers the status code a handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Route template for r, such as /humans/{id}, so requests for different
+// ids are logged under the same name
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return r.URL.Path
+}
+
+// Log requests that take longer than slow, and every request at debug level
+func requestLogMiddleware(slow time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			elapsed := time.Since(start)
+			if elapsed >= slow {
+				log.Printf("SLOW %s %s %d %s", r.Method, routeTemplate(r), rec.status, elapsed)
+				return
+			}
+			debugf("%s %s %d %s", r.Method, routeTemplate(r), rec.status, elapsed)
+		})
+	}
+}
@@ -1,191 +1,870 @@
-package main
-
-import (
-	"database/sql"
-	"encoding/json"
-	"log"
-	"net/http"
-	"os"
-
-	"github.com/gorilla/mux"
-	"github.com/gorilla/handlers"
-	_ "github.com/lib/pq"
-)
-
-type User struct {
-	ID     int    `json:"id"`
-	F_name string `json:"F_name"`
-	L_name string `json:"L_name"`
-}
-
-func main() {
-	// Connect to database
-	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
-	if err != nil {
-		log.Fatal("Failed to connect to database:", err)
-	}
-	defer db.Close()
-
-	// Create the table if it doesn't exist
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS humans (id SERIAL PRIMARY KEY, F_name TEXT, L_name TEXT)")
-	if err != nil {
-		log.Fatal("Failed to create table:", err)
-	}
-
-	// Create router
-	router := mux.NewRouter()
-	router.Use(jsonContentTypeMiddleware)
-	router.HandleFunc("/", rootHandler).Methods("GET")
-	router.HandleFunc("/humans", getUsers(db)).Methods("GET")
-	router.HandleFunc("/humans/{id}", getUser(db)).Methods("GET")
-	router.HandleFunc("/humans", createUser(db)).Methods("POST")
-	router.HandleFunc("/humans/{id}", updateUser(db)).Methods("PUT")
-	router.HandleFunc("/humans/{id}", deleteUser(db)).Methods("DELETE")
-
-	// ใช้งาน CORS
-	corsHandler := handlers.CORS(
-		handlers.AllowedOrigins([]string{"*"}), // สามารถปรับ URL นี้ตามความต้องการ
-		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE"}),
-		handlers.AllowedHeaders([]string{"Content-Type"}),
-	)
-
-	// Start server
-	log.Println("Server running on port 8000")
-	log.Fatal(http.ListenAndServe(":8000", corsHandler(router))) // ใช้ CORS handler
-}
-
-func jsonContentTypeMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		next.ServeHTTP(w, r)
-	})
-}
-
-// Root handler
-func rootHandler(w http.ResponseWriter, r *http.Request) {
-	response := map[string]string{
-		"Create": "POST: /humans",
-		"ReadAll": "GET: /humans",
-		"ReadOne": "GET: /humans/{id}",
-		"Update": "PUT: /humans/{id}",
-		"Delete": "DELETE: /humans/{id}",
-	}
-	json.NewEncoder(w).Encode(response)
-}
-
-// Get all users
-func getUsers(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		rows, err := db.Query("SELECT id, F_name, L_name FROM humans")
-		if err != nil {
-			http.Error(w, "Failed to retrieve users", http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		var users []User
-		for rows.Next() {
-			var u User
-			if err := rows.Scan(&u.ID, &u.F_name, &u.L_name); err != nil {
-				http.Error(w, "Error scanning user", http.StatusInternalServerError)
-				return
-			}
-			users = append(users, u)
-		}
-		if err := rows.Err(); err != nil {
-			http.Error(w, "Error with rows", http.StatusInternalServerError)
-			return
-		}
-
-		json.NewEncoder(w).Encode(users)
-	}
-}
-
-// Get user by ID
-func getUser(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		id := vars["id"]
-
-		var u User
-		err := db.QueryRow("SELECT id, F_name, L_name FROM humans WHERE id = $1", id).Scan(&u.ID, &u.F_name, &u.L_name)
-		if err == sql.ErrNoRows {
-			http.Error(w, "User not found", http.StatusNotFound)
-			return
-		} else if err != nil {
-			http.Error(w, "Failed to retrieve user", http.StatusInternalServerError)
-			return
-		}
-
-		json.NewEncoder(w).Encode(u)
-	}
-}
-
-// Create user
-func createUser(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var u User
-		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
-			return
-		}
-
-		err := db.QueryRow("INSERT INTO humans (F_name, L_name) VALUES ($1, $2) RETURNING id", u.F_name, u.L_name).Scan(&u.ID)
-		if err != nil {
-			http.Error(w, "Failed to create user", http.StatusInternalServerError)
-			return
-		}
-
-		json.NewEncoder(w).Encode(u)
-	}
-}
-
-// Update user
-func updateUser(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		id := vars["id"]
-
-		var u User
-		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
-			return
-		}
-
-		result, err := db.Exec("UPDATE humans SET F_name = $1, L_name = $2 WHERE id = $3", u.F_name, u.L_name, id)
-		if err != nil {
-			http.Error(w, "Failed to update user", http.StatusInternalServerError)
-			return
-		}
-
-		rowsAffected, _ := result.RowsAffected()
-		if rowsAffected == 0 {
-			http.Error(w, "User not found", http.StatusNotFound)
-			return
-		}
-
-		json.NewEncoder(w).Encode(u)
-	}
-}
-
-// Delete user
-func deleteUser(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		id := vars["id"]
-
-		result, err := db.Exec("DELETE FROM humans WHERE id = $1", id)
-		if err != nil {
-			http.Error(w, "Failed to delete user", http.StatusInternalServerError)
-			return
-		}
-
-		rowsAffected, _ := result.RowsAffected()
-		if rowsAffected == 0 {
-			http.Error(w, "User not found", http.StatusNotFound)
-			return
-		}
-
-		json.NewEncoder(w).Encode(map[string]string{"message": "User deleted"})
-	}
-}
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"golang.org/x/sync/singleflight"
+)
+
+// responseEnvelope wraps every response as {"success":...,"data":...}
+// when RESPONSE_ENVELOPE=true.
+var responseEnvelope bool
+
+// debugLogging enables debugf output; it starts on when LOG_LEVEL=debug.
+var debugLogging flag
+
+// readOnly rejects every write method while on, starting from READONLY.
+var readOnly flag
+
+// listCache lets /humans reads be cached for LIST_CACHE_SECONDS while on.
+var listCache flag
+
+// table is the validated TABLE_NAME every query runs against.
+var table = "humans"
+
+// User is a stored human. Its JSON form depends on JSON_FIELD_STYLE; see
+// wire.go.
+type User struct {
+	ID        UserID
+	F_name    string
+	L_name    *string
+	ViewCount int64
+	Tags      []string
+	Active    bool
+	CreatedAt Timestamp
+	UpdatedAt Timestamp
+}
+
+func main() {
+	cfg := loadConfig()
+	log.Printf("Config: %s", cfg)
+	if err := cfg.validate(); err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	responseEnvelope = cfg.ResponseEnvelope
+	table = cfg.TableName
+	writeAttempts = cfg.WriteRetryAttempts
+	userReadTimeout = cfg.StatementTimeout
+	maxBatchSize = cfg.MaxBatchSize
+	readAttempts = cfg.ReadRetryAttempts
+	maxTags, maxTagLength = cfg.MaxTags, cfg.MaxTagLength
+	nameMaxLength, namePattern = cfg.NameMaxLength, regexp.MustCompile(cfg.NamePattern)
+	controlChars = cfg.ControlChars
+	outboxEnabled = cfg.OutboxWebhookURL != ""
+	webhookURL = cfg.WebhookURL
+	searchMaxResults, listWarnResults = cfg.SearchMaxResults, cfg.ListWarnResults
+	idAsString = cfg.IDAsString
+	jsonFieldStyle = cfg.JSONFieldStyle
+	jsonEscapeHTML = cfg.JSONEscapeHTML
+	notFoundHints = cfg.NotFoundHints
+	debugLogging.set(cfg.LogLevel == "debug")
+	readOnly.set(cfg.ReadOnly)
+	listCache.set(cfg.ListCacheMaxAge > 0)
+	maintenanceMode.set(cfg.MaintenanceMode)
+
+	// Connect to database. sslmode is only added when DB_SSLMODE or
+	// PGSSLMODE gives one, since a DSN key would override PGSSLMODE
+	dsn, sslmode := cfg.DatabaseURL, "require"
+	if cfg.DBSSLMode != "" {
+		dsn, sslmode = applyDSNDefault(dsn, "sslmode", cfg.DBSSLMode)
+	} else if v := dsnValue(dsn, "sslmode"); v != "" {
+		sslmode = v
+	}
+	// lib/pq sends unknown DSN keys as session settings, so the server
+	// enforces statement_timeout on every connection
+	dsn, timeout := applyDSNDefault(dsn, "statement_timeout", strconv.FormatInt(cfg.StatementTimeout.Milliseconds(), 10))
+	if cfg.DBPassword != "" {
+		dsn = applyPassword(dsn, cfg.DBPassword)
+	}
+	log.Println("Database sslmode:", sslmode)
+	log.Printf("Database statement_timeout: %sms", timeout)
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+
+	// Create the table if it doesn't exist, unless the schema is managed
+	// outside the app, in which case it must already be in place
+	if cfg.AutoCreateSchema {
+		if err := ensureSchema(db); err != nil {
+			log.Fatal("Failed to create table:", err)
+		}
+	} else if err := checkSchema(db); err != nil {
+		log.Fatal("Schema check failed (AUTO_CREATE_SCHEMA=false): ", err)
+	}
+
+	// Watch the database in the background so /readyz reflects outages
+	health := &dbHealth{}
+	go watchDB(db, health, cfg.HealthCheckInterval, cfg.HealthCheckTimeout, cfg.HealthCheckMaxFailures)
+	if cfg.LogDBStats {
+		go logDBStats(db, cfg.DBStatsInterval)
+	}
+
+	// Count profile views, batching the writes
+	views := newViewCounter()
+	go views.run(db, cfg.ViewFlushInterval)
+
+	// Batch plain creates when buffered writes are enabled
+	var buffer *writeBuffer
+	if cfg.BufferedWrites {
+		buffer = newWriteBuffer(db, cfg.BufferBatchSize, cfg.BufferFlushInterval)
+		go buffer.run()
+	}
+
+	// Deliver change events recorded in the outbox
+	if outboxEnabled {
+		go runOutbox(db, cfg.OutboxWebhookURL, cfg.OutboxPollInterval)
+	}
+
+	// Create router
+	router := mux.NewRouter()
+	router.Use(requestLogMiddleware(cfg.SlowRequestThreshold))
+	router.Use(jsonContentTypeMiddleware)
+	router.Use(cacheControlMiddleware(cfg.ListCacheMaxAge, cfg.CacheJitter))
+	router.Use(disabledMethodsMiddleware(cfg.DisabledMethods))
+	router.Use(maintenanceModeMiddleware(cfg.MaintenanceRetryAfter))
+	if len(cfg.BlockedUserAgents) > 0 {
+		router.Use(blockUserAgentsMiddleware(cfg.BlockedUserAgents))
+	}
+	if cfg.RateLimitPerMinute > 0 || len(cfg.RateLimitKeys) > 0 {
+		router.Use(rateLimitMiddleware(newRateLimiter(cfg.RateLimitPerMinute, cfg.RateLimitKeys)))
+	}
+	router.Use(idParamMiddleware)
+	router.HandleFunc("/", rootHandler).Methods("GET")
+	router.HandleFunc("/readyz", readyHandler(health)).Methods("GET")
+	router.HandleFunc("/humans", getUsers(db)).Methods("GET")
+	router.HandleFunc("/humans/most-viewed", getMostViewed(db)).Methods("GET")
+	router.HandleFunc("/humans/bounds", getBounds(db)).Methods("GET")
+	router.HandleFunc("/humans/group-count", getGroupCount(db)).Methods("GET")
+	router.HandleFunc("/humans/changes", getChanges(db)).Methods("GET")
+	router.HandleFunc("/humans/export.json", exportJSON(db)).Methods("GET")
+	router.HandleFunc("/humans/export.csv", exportCSV(db)).Methods("GET")
+	router.HandleFunc("/humans/schema", getSchema).Methods("GET")
+	router.HandleFunc("/humans/{id}", getUser(db, views)).Methods("GET")
+	router.HandleFunc("/humans/{id}/card", getCard(db)).Methods("GET")
+	router.HandleFunc("/humans", createUser(db, buffer)).Methods("POST")
+	router.HandleFunc("/humans/merge", mergeUsers(db)).Methods("POST")
+	router.HandleFunc("/humans/batch", batchUsers(db)).Methods("POST")
+	router.HandleFunc("/humans/import", importUsers(db)).Methods("POST")
+	router.HandleFunc("/humans/tag-matching", tagMatching(db)).Methods("POST")
+	router.HandleFunc("/humans/{id}", updateUser(db)).Methods("PUT")
+	router.HandleFunc("/humans/{id}", deleteUser(db)).Methods("DELETE")
+	router.HandleFunc("/humans/{id}/tags", updateTags(db)).Methods("POST")
+	router.HandleFunc("/humans", describeRoute("/humans", []string{"GET", "POST"}, cfg.DisabledMethods)).Methods("OPTIONS")
+	router.HandleFunc("/humans/{id}", describeRoute("/humans/{id}", []string{"GET", "PUT", "DELETE"}, cfg.DisabledMethods)).Methods("OPTIONS")
+	router.HandleFunc("/humans/{id}/activate", setActive(db, true)).Methods("POST")
+	router.HandleFunc("/humans/{id}/deactivate", setActive(db, false)).Methods("POST")
+
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(adminAuthMiddleware(cfg.AdminAPIKey))
+	admin.HandleFunc("/maintenance", maintenanceHandler(db)).Methods("POST")
+	admin.HandleFunc("/maintenance-mode", maintenanceModeHandler).Methods("GET", "PUT")
+	admin.HandleFunc("/flags", flagsHandler).Methods("GET", "PUT")
+
+	if err := checkDuplicateRoutes(router); err != nil {
+		log.Fatal("Invalid routes: ", err)
+	}
+
+	// ใช้งาน CORS
+	corsHandler := handlers.CORS(
+		handlers.AllowedOrigins(cfg.CORSOrigins), // สามารถปรับ URL นี้ตามความต้องการ
+		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "Content-Encoding", "X-API-Key", "If-Match", "Prefer"}),
+		handlers.ExposedHeaders([]string{"ETag", "X-Result-Truncated", "X-Large-Result", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Retry-After", "Location", "Preference-Applied"}),
+	)
+
+	// CORS covers only the /humans API; probes and admin routes skip it
+	var handler http.Handler = pathPrefixMiddleware("/humans", preflightOnly(corsHandler))(router) // ใช้ CORS handler
+	if cfg.MaxResponseBytes > 0 {
+		handler = maxResponseBytesMiddleware(int64(cfg.MaxResponseBytes))(handler)
+	}
+	if cfg.Compression {
+		handler = compressMiddleware(cfg.CompressMinBytes)(handler)
+	}
+	handler = requestEncodingMiddleware(int64(cfg.MaxDecompressedBytes))(handler)
+	if cfg.ForceHTTPS {
+		handler = httpsRedirectMiddleware(handler)
+	}
+	handler = maxURLLengthMiddleware(cfg.MaxURLLength)(handler)
+	handler = inFlightMiddleware(handler)
+
+	// Start server
+	ln, err := listen(cfg)
+	if err != nil {
+		log.Fatal("Failed to listen:", err)
+	}
+	if err := serve(&http.Server{Handler: handler}, ln, cfg.ShutdownTimeout); err != nil {
+		log.Println("Server stopped:", err)
+	}
+	if cfg.ListenSocket != "" {
+		os.Remove(cfg.ListenSocket)
+	}
+	if buffer != nil {
+		buffer.close()
+	}
+	views.flush(db)
+}
+
+// Apply mw only to requests under prefix
+func pathPrefixMiddleware(prefix string, mw func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		wrapped := mw(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+				wrapped.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Wrap a CORS handler so that an OPTIONS request which is not a preflight
+// reaches the router instead of being answered empty
+func preflightOnly(cors func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		wrapped := cors(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			wrapped.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Fail when two routes claim the same method and path template, since
+// mux would silently dispatch to whichever was registered first
+func checkDuplicateRoutes(router *mux.Router) error {
+	seen := map[string]bool{}
+	return router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// Prefixes such as /admin only group their subroutes
+			return nil
+		}
+		for _, m := range methods {
+			key := m + " " + tmpl
+			if seen[key] {
+				return fmt.Errorf("%s is registered more than once", key)
+			}
+			seen[key] = true
+		}
+		return nil
+	})
+}
+
+// Log only when debug logging is enabled
+func debugf(format string, args ...interface{}) {
+	if debugLogging.on() {
+		log.Printf("DEBUG "+format, args...)
+	}
+}
+
+func jsonContentTypeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Let clients cache /humans reads for maxAge, plus up to a tenth more at
+// random when jitter is set so polling clients drift apart. Writes are
+// never cached.
+func cacheControlMiddleware(maxAge time.Duration, jitter bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasPrefix(r.URL.Path, "/humans") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			switch r.Method {
+			case "GET", "HEAD":
+				if maxAge > 0 && listCache.on() {
+					seconds := int(maxAge.Seconds())
+					if jitter {
+						seconds += rand.Intn(seconds/10 + 1)
+					}
+					w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(seconds))
+				}
+			default:
+				w.Header().Set("Cache-Control", "no-store")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// probePaths are left reachable over plain HTTP for internal health checks.
+var probePaths = map[string]bool{"/readyz": true}
+
+// Redirect requests that reached the load balancer over plain HTTP
+func httpsRedirectMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Forwarded-Proto") == "http" && !probePaths[r.URL.Path] {
+			http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Reject overly long URLs before they reach routing or query parsing
+func maxURLLengthMiddleware(max int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(r.URL.RequestURI()) > max {
+				w.Header().Set("Content-Type", "application/json")
+				writeError(w, http.StatusRequestURITooLong, fmt.Sprintf("URL exceeds %d characters", max))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// writeMethods are the methods that change data.
+var writeMethods = map[string]bool{"POST": true, "PUT": true, "PATCH": true, "DELETE": true}
+
+// Reject requests whose method has been disabled, and every write while
+// the server is read-only
+func disabledMethodsMiddleware(disabled map[string]bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if disabled[r.Method] || writeMethods[r.Method] && readOnly.on() && !strings.HasPrefix(r.URL.Path, "/admin/") {
+				writeError(w, http.StatusForbidden, r.Method+" is disabled on this server")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Reject requests whose User-Agent contains any of the blocked substrings,
+// compared case-insensitively
+func blockUserAgentsMiddleware(blocked []string) mux.MiddlewareFunc {
+	for i, b := range blocked {
+		blocked[i] = strings.ToLower(b)
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ua := strings.ToLower(r.UserAgent())
+			for _, b := range blocked {
+				if strings.Contains(ua, b) {
+					log.Printf("Blocked user agent %q from %s: %s %s", r.UserAgent(), r.RemoteAddr, r.Method, r.URL.Path)
+					writeError(w, http.StatusForbidden, "Forbidden")
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Read a positive integer query parameter, defaulting to def and capped at max
+func queryInt(r *http.Request, key string, def, max int) (int, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s must be a positive integer", key)
+	}
+	if n > max {
+		n = max
+	}
+	return n, nil
+}
+
+// Write v as the JSON response body, wrapped in the envelope when enabled
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	if responseEnvelope {
+		v = map[string]interface{}{
+			"success":   true,
+			"data":      v,
+			"timestamp": time.Now().UTC().Format(time.RFC3339),
+		}
+	}
+	w.WriteHeader(status)
+	newJSONEncoder(w).Encode(v)
+}
+
+// Write a JSON error body with the given status code
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeErrorDetails(w, status, message, nil)
+}
+
+// Write a JSON error body carrying extra fields alongside the message
+func writeErrorDetails(w http.ResponseWriter, status int, message string, details map[string]interface{}) {
+	v := map[string]interface{}{"error": message}
+	if responseEnvelope {
+		v["success"] = false
+	}
+	for k, d := range details {
+		v[k] = d
+	}
+	w.WriteHeader(status)
+	newJSONEncoder(w).Encode(v)
+}
+
+// Report whether the request's Prefer header asks for return=minimal
+// (RFC 7240); return=representation, the default, sends the body
+func prefersMinimal(r *http.Request) bool {
+	for _, v := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(strings.Split(pref, ";")[0]), "return=minimal") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Answer a successful write with u, or with 204 when the client prefers
+// a minimal response
+func writeRepresentation(w http.ResponseWriter, r *http.Request, u User) {
+	if prefersMinimal(r) {
+		w.Header().Set("Preference-Applied", "return=minimal")
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, u)
+}
+
+// endpoints lists every route as "METHOD: path", served at / and, per
+// route, by OPTIONS.
+var endpoints = map[string]string{
+	"Create":  "POST: /humans",
+	"ReadAll": "GET: /humans",
+	"ReadOne": "GET: /humans/{id}",
+	"Update":  "PUT: /humans/{id}",
+	"Delete":  "DELETE: /humans/{id}",
+
+	"MostViewed":  "GET: /humans/most-viewed",
+	"Bounds":      "GET: /humans/bounds",
+	"GroupCount":  "GET: /humans/group-count?by=L_name",
+	"Tags":        "POST: /humans/{id}/tags",
+	"Card":        "GET: /humans/{id}/card",
+	"Activate":    "POST: /humans/{id}/activate",
+	"Deactivate":  "POST: /humans/{id}/deactivate",
+	"Changes":     "GET: /humans/changes?since=",
+	"ExportJSON":  "GET: /humans/export.json",
+	"ExportCSV":   "GET: /humans/export.csv?q=",
+	"Schema":      "GET: /humans/schema",
+	"Merge":       "POST: /humans/merge",
+	"Batch":       "POST: /humans/batch",
+	"Import":      "POST: /humans/import (application/x-ndjson)",
+	"TagMatching": "POST: /humans/tag-matching",
+}
+
+// Root handler
+func rootHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, endpoints)
+}
+
+// Answer OPTIONS on path with an Allow header for the methods that are
+// not disabled, and the operations from endpoints that the path serves
+func describeRoute(path string, methods []string, disabled map[string]bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+		operations := map[string]string{}
+		for _, m := range methods {
+			if !disabled[m] && !(writeMethods[m] && readOnly.on()) {
+				allowed = append(allowed, m)
+			}
+		}
+		for name, e := range endpoints {
+			for _, m := range allowed {
+				if e == m+": "+path {
+					operations[name] = e
+				}
+			}
+		}
+		allowed = append(allowed, "OPTIONS")
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"path": path, "operations": operations})
+	}
+}
+
+// Get all users
+func getUsers(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fields, err := parseFields(r.URL.Query().Get("fields"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		columns := fieldColumns(fields)
+		lq, err := parseListQuery(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		ctx := r.Context()
+		if ok, err := lq.checkCollation(ctx, db); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to retrieve users")
+			return
+		} else if !ok {
+			writeError(w, http.StatusBadRequest, "locale: no collation installed for "+r.URL.Query().Get("locale"))
+			return
+		}
+		rows, err := queryRead(ctx, db, lq.selectSQL(columns), lq.args...)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to retrieve users")
+			return
+		}
+		defer rows.Close()
+		searching := lq.score != ""
+		next := listRowDecoder(columns, fields, searching)
+
+		if wantsNDJSON(r) {
+			streamNDJSON(ctx, w, rows, next, lq.max)
+			return
+		}
+
+		users := []interface{}{}
+		for rows.Next() {
+			// Stop scanning once the client has gone away
+			if ctx.Err() != nil {
+				debugf("getUsers: client disconnected after %d rows: %v", len(users), ctx.Err())
+				return
+			}
+			u, err := next(rows)
+			if err != nil {
+				// A scan failure means the schema and model disagree
+				log.Printf("getUsers: schema mismatch after %d rows: %v", len(users), err)
+				writeError(w, http.StatusInternalServerError, "Error scanning user")
+				return
+			}
+			users = append(users, u)
+		}
+		if err := rows.Err(); err != nil {
+			if ctx.Err() != nil {
+				debugf("getUsers: client disconnected after %d rows: %v", len(users), ctx.Err())
+				return
+			}
+			// Failing while reading rows is usually a lost connection
+			log.Printf("getUsers: reading rows failed after %d rows: %v", len(users), err)
+			writeError(w, http.StatusServiceUnavailable, "Database connection lost while reading users")
+			return
+		}
+
+		// Searches are capped and say so in the body. Plain lists are
+		// complete; large ones get a header and a warning so
+		// non-paginating clients can be found
+		if searching {
+			truncated := len(users) > lq.max
+			if truncated {
+				users = users[:lq.max]
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"results": users, "truncated": truncated})
+			return
+		}
+		if len(users) > listWarnResults {
+			log.Printf("WARNING: %s from %s returned %d rows, above %d (%q)", r.URL.Path, r.RemoteAddr, len(users), listWarnResults, r.UserAgent())
+			w.Header().Set("X-Large-Result", "true")
+		}
+		writeJSON(w, http.StatusOK, users)
+	}
+}
+
+// userReads coalesces concurrent getUser queries for the same id. Writes
+// never go through it; a read that joins a query already in flight may
+// miss a write committed while that query ran.
+var userReads singleflight.Group
+
+// userReadTimeout bounds a shared getUser query, which runs detached from
+// any one caller's request; set from STATEMENT_TIMEOUT_MS.
+var userReadTimeout = 5 * time.Second
+
+// Get user by ID
+func getUser(db *sql.DB, views *viewCounter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		// Concurrent reads of the same id share one query. It must not
+		// use the first caller's context, or that client going away
+		// would fail every request waiting on it; each caller instead
+		// stops waiting when its own request ends
+		result := userReads.DoChan(id, func() (interface{}, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), userReadTimeout)
+			defer cancel()
+			var u User
+			err := runRead(ctx, func() error {
+				return db.QueryRowContext(ctx, "SELECT "+selectList(userColumns)+" FROM "+table+" WHERE id = $1", id).Scan(scanTargets(&u, userColumns)...)
+			})
+			return u, err
+		})
+		var res singleflight.Result
+		select {
+		case res = <-result:
+		case <-r.Context().Done():
+			debugf("getUser: client disconnected: %v", r.Context().Err())
+			return
+		}
+		v, err := res.Val, res.Err
+		if err == sql.ErrNoRows {
+			writeUserNotFound(r.Context(), w, db, id)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to retrieve user")
+			return
+		}
+		u := v.(User)
+		// Include this view and any not yet flushed
+		u.ViewCount += views.add(int(u.ID))
+
+		w.Header().Set("ETag", userETag(int(u.ID), u.UpdatedAt.Time))
+		writeJSON(w, http.StatusOK, u)
+	}
+}
+
+// Create user
+func createUser(db *sql.DB, buffer *writeBuffer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var u User
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+
+		if u.Tags == nil {
+			u.Tags = []string{}
+		}
+		if err := validateCreate(&u); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+
+		uniqueOn, err := parseUniqueOn(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		ctx := r.Context()
+		var existing *User
+		if buffer != nil && uniqueOn == nil {
+			// Conditional creates need their own query, so only plain ones
+			// are buffered
+			err = buffer.create(ctx, &u)
+		} else {
+			err = runWrite(ctx, db, func(tx *sql.Tx) (err error) {
+				if uniqueOn == nil {
+					return insertUser(ctx, tx, &u)
+				}
+				existing, err = insertUnlessExists(ctx, tx, &u, uniqueOn)
+				if err != nil || existing != nil {
+					return err
+				}
+				return enqueueEvent(ctx, tx, "create", u)
+			})
+		}
+		if err == errBufferClosed {
+			writeError(w, http.StatusServiceUnavailable, "Server is shutting down")
+			return
+		}
+		if err != nil {
+			writeWriteError(w, err, "Failed to create user")
+			return
+		}
+		if existing != nil {
+			// The match ignores case, so show the casing that is stored
+			writeErrorDetails(w, http.StatusPreconditionFailed, "A matching user already exists",
+				map[string]interface{}{"id": existing.ID, "existing": projectUser(*existing, uniqueOn)})
+			return
+		}
+		notifyChange("create", u)
+
+		w.Header().Set("Location", "/humans/"+strconv.Itoa(int(u.ID)))
+		writeRepresentation(w, r, u)
+	}
+}
+
+// Update user
+func updateUser(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		var body json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		u, present, err := decodeUpdate(body, id)
+		if err == errIDMismatch {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		if err := validateUpdate(&u, present); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+
+		// With If-Match the row is locked and only updated if it has not
+		// changed since the client read it
+		ifMatch := r.Header.Get("If-Match")
+		var current string
+
+		err = runWrite(r.Context(), db, func(tx *sql.Tx) error {
+			if ifMatch != "" {
+				var rowID int
+				var updatedAt time.Time
+				err := tx.QueryRowContext(r.Context(), "SELECT id, updated_at FROM "+table+" WHERE id = $1 FOR UPDATE", id).Scan(&rowID, &updatedAt)
+				if err != nil {
+					return err
+				}
+				if current = userETag(rowID, updatedAt); !etagMatches(ifMatch, current) {
+					return errETagMismatch
+				}
+			}
+			return updateUserRow(r.Context(), tx, id, &u, present)
+		})
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "User not found")
+			return
+		} else if err == errETagMismatch {
+			w.Header().Set("ETag", current)
+			writeError(w, http.StatusPreconditionFailed, "User was modified since it was read")
+			return
+		} else if err != nil {
+			writeWriteError(w, err, "Failed to update user")
+			return
+		}
+		notifyChange("update", u)
+
+		w.Header().Set("ETag", userETag(int(u.ID), u.UpdatedAt.Time))
+		writeRepresentation(w, r, u)
+	}
+}
+
+// Delete user
+func deleteUser(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		var deleted UserID
+		err := runWrite(r.Context(), db, func(tx *sql.Tx) (err error) {
+			deleted, err = deleteUserRow(r.Context(), tx, id)
+			return err
+		})
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "User not found")
+			return
+		} else if err != nil {
+			writeWriteError(w, err, "Failed to delete user")
+			return
+		}
+		notifyChange("delete", map[string]UserID{"id": deleted})
+
+		writeJSON(w, http.StatusOK, map[string]string{"message": "User deleted"})
+	}
+}
+
+// Insert u, filling it from the stored row, and record the event
+func insertUser(ctx context.Context, tx *sql.Tx, u *User) error {
+	err := tx.QueryRowContext(ctx, "INSERT INTO "+table+" (F_name, L_name, tags) VALUES ($1, $2, $3) RETURNING "+selectList(userColumns),
+		u.F_name, u.L_name, pq.Array(u.Tags)).Scan(scanTargets(u, userColumns)...)
+	if err != nil {
+		return err
+	}
+	return enqueueEvent(ctx, tx, "create", *u)
+}
+
+var errIDMismatch = errors.New("id in body does not match path")
+
+// Decode an update body for row id into the user and note which fields
+// were sent, so that omitted fields keep their stored values. Ids are
+// immutable, so a body id other than id is refused with errIDMismatch.
+func decodeUpdate(body []byte, id string) (User, map[string]bool, error) {
+	var fields map[string]json.RawMessage
+	var u User
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return u, nil, err
+	}
+	if err := json.Unmarshal(body, &u); err != nil {
+		return u, nil, err
+	}
+	present := map[string]bool{}
+	for k := range fields {
+		if f := internalName(k); f != "" {
+			present[f] = true
+		}
+	}
+	if present["id"] {
+		if pathID, err := parseUserID(id); err != nil || u.ID != pathID {
+			return u, nil, errIDMismatch
+		}
+	}
+	return u, present, nil
+}
+
+// Write the present fields of u to row id, filling u from the updated
+// row, and record the event. sql.ErrNoRows means there is no such row.
+func updateUserRow(ctx context.Context, tx *sql.Tx, id string, u *User, present map[string]bool) error {
+	var args []interface{}
+	sets := []string{"updated_at = now()"}
+	set := func(column string, v interface{}) {
+		args = append(args, v)
+		sets = append(sets, column+" = $"+strconv.Itoa(len(args)))
+	}
+	if present["F_name"] {
+		set("F_name", u.F_name)
+	}
+	if present["L_name"] {
+		set("L_name", u.L_name)
+	}
+	if u.Tags != nil {
+		set("tags", pq.Array(u.Tags))
+	}
+	args = append(args, id)
+	update := "UPDATE " + table + " SET " + strings.Join(sets, ", ") +
+		" WHERE id = $" + strconv.Itoa(len(args)) + " RETURNING " + selectList(userColumns)
+
+	if err := tx.QueryRowContext(ctx, update, args...).Scan(scanTargets(u, userColumns)...); err != nil {
+		return err
+	}
+	return enqueueEvent(ctx, tx, "update", *u)
+}
+
+// Delete row id and record the event. sql.ErrNoRows means there is no
+// such row.
+func deleteUserRow(ctx context.Context, tx *sql.Tx, id string) (UserID, error) {
+	var deleted UserID
+	if err := tx.QueryRowContext(ctx, "DELETE FROM "+table+" WHERE id = $1 RETURNING id", id).Scan(&deleted); err != nil {
+		return 0, err
+	}
+	return deleted, enqueueEvent(ctx, tx, "delete", map[string]UserID{"id": deleted})
+}
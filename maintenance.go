@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maintenanceMode is on while writes are frozen. It starts from
+// MAINTENANCE_MODE and can be flipped at runtime by the admin endpoints.
+var maintenanceMode flag
+
+// Answer writes with 503 while maintenance mode is on; reads still work.
+// Admin routes are exempt so the mode can be switched off again.
+func maintenanceModeMiddleware(retryAfter time.Duration) mux.MiddlewareFunc {
+	seconds := strconv.Itoa(int(retryAfter.Seconds()))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if writeMethods[r.Method] && maintenanceMode.on() && !strings.HasPrefix(r.URL.Path, "/admin/") {
+				w.Header().Set("Retry-After", seconds)
+				writeError(w, http.StatusServiceUnavailable, "Writes are paused for maintenance, try again later")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Report or, on PUT with {"enabled": bool}, switch maintenance mode
+func maintenanceModeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		var body struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Enabled == nil {
+			writeError(w, http.StatusBadRequest, `Body must be {"enabled": true|false}`)
+			return
+		}
+		maintenanceMode.set(*body.Enabled)
+		log.Printf("Maintenance mode set to %t", *body.Enabled)
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"enabled": maintenanceMode.on()})
+}
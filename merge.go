@@ -0,0 +1,76 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/lib/pq"
+)
+
+// Merge a duplicate human into a canonical one. In one transaction the
+// duplicate is deleted and its view count and tags are folded into the
+// survivor, which is returned.
+func mergeUsers(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			KeepID  UserID `json:"keep_id"`
+			MergeID UserID `json:"merge_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		if body.KeepID == 0 || body.MergeID == 0 {
+			writeError(w, http.StatusBadRequest, "keep_id and merge_id are required")
+			return
+		}
+		if body.KeepID == body.MergeID {
+			writeError(w, http.StatusBadRequest, "keep_id and merge_id must differ")
+			return
+		}
+
+		var u User
+		err := runWrite(r.Context(), db, func(tx *sql.Tx) error {
+			var views int64
+			var tags []string
+			err := tx.QueryRowContext(r.Context(), "DELETE FROM "+table+" WHERE id = $1 RETURNING view_count, tags",
+				body.MergeID).Scan(&views, pq.Array(&tags))
+			if err != nil {
+				return err
+			}
+			// Nothing else references humans yet; repoint related rows here
+			// once other tables do
+			err = tx.QueryRowContext(r.Context(), "UPDATE "+table+" SET view_count = view_count + $1, tags = ARRAY("+
+				"SELECT tag FROM unnest(tags || $2::text[]) WITH ORDINALITY AS t(tag, n) GROUP BY tag ORDER BY MIN(n)), "+
+				"updated_at = now() WHERE id = $3 RETURNING "+selectList(userColumns),
+				views, pq.Array(tags), body.KeepID).Scan(scanTargets(&u, userColumns)...)
+			if err != nil {
+				return err
+			}
+			if len(u.Tags) > maxTags {
+				return errTooManyTags
+			}
+			if err := enqueueEvent(r.Context(), tx, "delete", map[string]UserID{"id": body.MergeID}); err != nil {
+				return err
+			}
+			return enqueueEvent(r.Context(), tx, "update", u)
+		})
+		switch {
+		case err == sql.ErrNoRows:
+			writeError(w, http.StatusNotFound, "User not found")
+			return
+		case err == errTooManyTags:
+			writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("merged record would have more than %d tags", maxTags))
+			return
+		case err != nil:
+			writeWriteError(w, err, "Failed to merge users")
+			return
+		}
+		notifyChange("delete", map[string]UserID{"id": body.MergeID})
+		notifyChange("update", u)
+
+		writeJSON(w, http.StatusOK, u)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// notFoundHints adds navigation hints to getUser's 404 when
+// NOT_FOUND_HINTS=true, at the cost of one extra query.
+var notFoundHints bool
+
+// Answer a missing user with 404. With hints on, the body links to the
+// collection and to the closest existing ids below and above id.
+func writeUserNotFound(ctx context.Context, w http.ResponseWriter, db *sql.DB, id string) {
+	if !notFoundHints {
+		writeError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	hints := map[string]interface{}{"collection": "/humans"}
+	var prev, next sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT (SELECT MAX(id) FROM "+table+" WHERE id < $1), (SELECT MIN(id) FROM "+table+" WHERE id > $1)",
+		id).Scan(&prev, &next)
+	if err != nil {
+		log.Println("Failed to look up nearest ids:", err)
+	}
+	for key, n := range map[string]sql.NullInt64{"previous": prev, "next": next} {
+		if n.Valid {
+			hints[key] = map[string]interface{}{"id": UserID(n.Int64), "href": "/humans/" + strconv.FormatInt(n.Int64, 10)}
+		}
+	}
+	writeErrorDetails(w, http.StatusNotFound, "User not found", map[string]interface{}{"hints": hints})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// outboxEnabled turns on event recording; set when OUTBOX_WEBHOOK_URL is.
+var outboxEnabled bool
+
+// outboxBatchSize caps how many events one poll delivers.
+const outboxBatchSize = 100
+
+// changeEvent is the payload recorded for every create, update and delete.
+type changeEvent struct {
+	Operation string      `json:"operation"`
+	Table     string      `json:"table"`
+	Record    interface{} `json:"record"`
+}
+
+// Record a change event in the same transaction as the change itself,
+// so the event exists if and only if the change was committed.
+func enqueueEvent(ctx context.Context, tx *sql.Tx, operation string, record interface{}) error {
+	if !outboxEnabled {
+		return nil
+	}
+	payload, err := json.Marshal(changeEvent{Operation: operation, Table: table, Record: record})
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO events_outbox (table_name, payload) VALUES ($1, $2)", table, payload)
+	return err
+}
+
+// Deliver unpublished events to url every interval. Events are sent in
+// order and marked published only after the webhook accepts them, so a
+// crash between the two causes a redelivery, never a loss.
+func runOutbox(db *sql.DB, url string, interval time.Duration) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	for range time.Tick(interval) {
+		n, err := publishOutbox(db, client, url)
+		if err != nil {
+			log.Printf("Outbox: delivered %d events, then failed: %v", n, err)
+		} else if n > 0 {
+			debugf("Outbox: delivered %d events", n)
+		}
+	}
+}
+
+// Deliver one batch of pending events, returning how many were published
+func publishOutbox(db *sql.DB, client *http.Client, url string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// SKIP LOCKED lets several instances share the outbox without
+	// delivering the same event twice at the same time
+	rows, err := tx.Query("SELECT id, payload FROM events_outbox WHERE table_name = $1 AND published_at IS NULL "+
+		"ORDER BY id LIMIT $2 FOR UPDATE SKIP LOCKED", table, outboxBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	type event struct {
+		id      int64
+		payload []byte
+	}
+	var events []event
+	for rows.Next() {
+		var e event
+		if err := rows.Scan(&e.id, &e.payload); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	published := 0
+	var deliverErr error
+	for _, e := range events {
+		if deliverErr = deliverEvent(client, url, e.id, e.payload); deliverErr != nil {
+			break
+		}
+		if _, err := tx.Exec("UPDATE events_outbox SET published_at = now() WHERE id = $1", e.id); err != nil {
+			return 0, err
+		}
+		published++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return published, deliverErr
+}
+
+func deliverEvent(client *http.Client, url string, id int64, payload []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-ID", strconv.FormatInt(id, 10))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("event %d: webhook answered %s", id, resp.Status)
+	}
+	return nil
+}
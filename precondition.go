@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// uniqueColumns are the stored fields createUser may be made unique on.
+var uniqueColumns = []string{"F_name", "L_name"}
+
+// Resolve the columns a create must be unique on. `If-None-Match: *`
+// means all of uniqueColumns; ?unique_on= picks a subset. Nil means the
+// create is unconditional.
+func parseUniqueOn(r *http.Request) ([]string, error) {
+	param := r.URL.Query().Get("unique_on")
+	if param == "" {
+		if r.Header.Get("If-None-Match") == "*" {
+			return uniqueColumns, nil
+		}
+		return nil, nil
+	}
+
+	var columns []string
+	for _, c := range strings.Split(param, ",") {
+		name := strings.TrimSpace(c)
+		c = internalName(name)
+		if !contains(uniqueColumns, c) {
+			return nil, fmt.Errorf("unique_on: unsupported field %q", name)
+		}
+		columns = append(columns, c)
+	}
+	return columns, nil
+}
+
+// Insert u unless a row already matches it on every column in uniqueOn,
+// ignoring case; names are stored as typed, but "mcdonald" duplicates
+// "McDonald". On success u is refilled from the stored row; otherwise the
+// matching row is returned.
+func insertUnlessExists(ctx context.Context, tx *sql.Tx, u *User, uniqueOn []string) (*User, error) {
+	values := make([]interface{}, len(uniqueOn))
+	for i, c := range uniqueOn {
+		values[i] = userFields[c].value(*u)
+	}
+
+	// Nothing in the schema enforces this, so two concurrent creates could
+	// both pass the NOT EXISTS check. Lock each of the new row's
+	// uniqueColumns values until the transaction ends, in a fixed order.
+	// Rows that would conflict share at least one of those values,
+	// whatever subset each is unique on, so the second create waits and
+	// then sees the first.
+	for _, c := range uniqueColumns {
+		_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1), hashtext(coalesce(lower($2::text), '')))",
+			table+"."+c, userFields[c].value(*u))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	args := append([]interface{}{u.F_name, u.L_name, pq.Array(u.Tags)}, values...)
+	err := tx.QueryRowContext(ctx, "INSERT INTO "+table+" (F_name, L_name, tags) SELECT $1::text, $2::text, $3::text[] "+
+		"WHERE NOT EXISTS (SELECT 1 FROM "+table+" WHERE "+matchColumns(uniqueOn, 4)+") RETURNING "+selectList(userColumns),
+		args...).Scan(scanTargets(u, userColumns)...)
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	var existing User
+	err = tx.QueryRowContext(ctx, "SELECT "+selectList(userColumns)+" FROM "+table+" WHERE "+matchColumns(uniqueOn, 1)+" ORDER BY id LIMIT 1",
+		values...).Scan(scanTargets(&existing, userColumns)...)
+	if err != nil {
+		return nil, err
+	}
+	return &existing, nil
+}
+
+// Build "lower(a) IS NOT DISTINCT FROM lower($n) AND ..." for the given
+// columns, so that case is ignored and a NULL L_name matches another NULL
+func matchColumns(columns []string, first int) string {
+	conds := make([]string, len(columns))
+	for i, c := range columns {
+		conds[i] = "lower(" + c + ") IS NOT DISTINCT FROM lower($" + strconv.Itoa(first+i) + "::text)"
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// errETagMismatch is returned from an update whose If-Match no longer holds.
+var errETagMismatch = errors.New("etag mismatch")
+
+// ETag of a stored user. It changes whenever the row is updated, but not
+// when only its view count moves.
+func userETag(id int, updatedAt time.Time) string {
+	return fmt.Sprintf(`"%d-%x"`, id, updatedAt.UnixMicro())
+}
+
+// Report whether an If-Match header value accepts etag. "*" matches any
+// existing row; weak validators never match, as If-Match needs strong ones.
+func etagMatches(header, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
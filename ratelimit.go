@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// rateLimitWindow is how long a client's request count lasts.
+const rateLimitWindow = time.Minute
+
+// rateLimiter counts requests per client in fixed one-minute windows.
+// Clients presenting a known X-API-Key get that key's limit whatever IP
+// they come from; everyone else is limited per IP.
+type rateLimiter struct {
+	ipLimit   int
+	keyLimits map[string]int
+
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+type rateBucket struct {
+	count int
+	reset time.Time
+}
+
+func newRateLimiter(ipLimit int, keyLimits map[string]int) *rateLimiter {
+	return &rateLimiter{ipLimit: ipLimit, keyLimits: keyLimits, buckets: map[string]*rateBucket{}}
+}
+
+// Pick the bucket and limit for r. Unknown keys are ignored so that
+// inventing keys cannot dodge the per-IP limit. A zero limit means the
+// client is not limited.
+func (l *rateLimiter) client(r *http.Request) (string, int) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		if limit, ok := l.keyLimits[key]; ok {
+			return "key:" + key, limit
+		}
+	}
+	return "ip:" + clientIP(r), l.ipLimit
+}
+
+// Count a request against bucket and report what is left of the window
+func (l *rateLimiter) take(bucket string, limit int, now time.Time) (remaining int, reset time.Time, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitWindow {
+		for k, b := range l.buckets {
+			if now.After(b.reset) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b := l.buckets[bucket]
+	if b == nil || now.After(b.reset) {
+		b = &rateBucket{reset: now.Add(rateLimitWindow)}
+		l.buckets[bucket] = b
+	}
+	if b.count >= limit {
+		return 0, b.reset, false
+	}
+	b.count++
+	return limit - b.count, b.reset, true
+}
+
+// Answer 429 once a client has used up its requests for the window,
+// reporting the client's bucket in X-RateLimit-* headers
+func rateLimitMiddleware(l *rateLimiter) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			bucket, limit := l.client(r)
+			if limit == 0 || probePaths[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			now := time.Now()
+			remaining, reset, ok := l.take(bucket, limit, now)
+			// Every limited response shows the bucket so clients can back
+			// off before they hit it; Reset is when the window restarts
+			h := w.Header()
+			h.Set("X-RateLimit-Limit", strconv.Itoa(limit))
+			h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+			h.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+			if !ok {
+				h.Set("Retry-After", strconv.Itoa(int(reset.Sub(now).Seconds())+1))
+				writeError(w, http.StatusTooManyRequests, "Rate limit exceeded")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Client address, preferring the X-Real-IP set by the nginx proxy
+func clientIP(r *http.Request) string {
+	if ip := r.Header.Get("X-Real-IP"); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
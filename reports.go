@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+)
+
+// Get the most viewed users, most popular first
+func getMostViewed(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, err := queryInt(r, "limit", 10, 100)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		rows, err := queryRead(r.Context(), db,
+			"SELECT "+selectList(userColumns)+" FROM "+table+" ORDER BY view_count DESC, id LIMIT $1", limit)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to retrieve users")
+			return
+		}
+		defer rows.Close()
+
+		users := []User{}
+		for rows.Next() {
+			var u User
+			if err := rows.Scan(scanTargets(&u, userColumns)...); err != nil {
+				writeError(w, http.StatusInternalServerError, "Error scanning user")
+				return
+			}
+			users = append(users, u)
+		}
+		if err := rows.Err(); err != nil {
+			writeError(w, http.StatusInternalServerError, "Error with rows")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, users)
+	}
+}
+
+// Get the lowest and highest id and the row count in one aggregate.
+// min_id and max_id are null when the table is empty.
+func getBounds(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var minID, maxID sql.NullInt64
+		var count int64
+		err := runRead(r.Context(), func() error {
+			return db.QueryRowContext(r.Context(), "SELECT MIN(id), MAX(id), COUNT(*) FROM "+table).Scan(&minID, &maxID, &count)
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to retrieve bounds")
+			return
+		}
+
+		response := map[string]interface{}{"min_id": nil, "max_id": nil, "count": count}
+		if minID.Valid {
+			response["min_id"] = UserID(minID.Int64)
+			response["max_id"] = UserID(maxID.Int64)
+		}
+		writeJSON(w, http.StatusOK, response)
+	}
+}
+
+// groupColumns are the columns /humans/group-count may group by.
+var groupColumns = []string{"F_name", "L_name"}
+
+// Count humans per distinct value of ?by=, most common first. ?limit=
+// sets the page size and ?page= walks high-cardinality columns.
+func getGroupCount(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		by := internalName(r.URL.Query().Get("by"))
+		if !contains(groupColumns, by) {
+			writeError(w, http.StatusBadRequest, "by must be one of "+wireName("F_name")+", "+wireName("L_name"))
+			return
+		}
+		limit, err := queryInt(r, "limit", 10, 100)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		page, err := queryInt(r, "page", 1, math.MaxInt32)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// by is whitelisted above, so it is safe to interpolate
+		rows, err := queryRead(r.Context(), db, "SELECT "+by+", COUNT(*) FROM "+table+
+			" GROUP BY "+by+" ORDER BY COUNT(*) DESC, "+by+" NULLS LAST LIMIT $1 OFFSET $2", limit, (page-1)*limit)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to count users")
+			return
+		}
+		defer rows.Close()
+
+		groups := []map[string]interface{}{}
+		for rows.Next() {
+			var value sql.NullString
+			var count int64
+			if err := rows.Scan(&value, &count); err != nil {
+				writeError(w, http.StatusInternalServerError, "Error scanning group")
+				return
+			}
+			group := map[string]interface{}{"value": nil, "count": count}
+			if value.Valid {
+				group["value"] = value.String
+			}
+			groups = append(groups, group)
+		}
+		if err := rows.Err(); err != nil {
+			writeError(w, http.StatusInternalServerError, "Error with rows")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{"by": wireName(by), "page": page, "limit": limit, "groups": groups})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// writeAttempts is how many times a write transaction is tried before
+// giving up; set from WRITE_RETRY_ATTEMPTS.
+var writeAttempts = 3
+
+var errWriteContention = errors.New("write retries exhausted")
+
+// Report whether err is a serialization failure or deadlock, which
+// Postgres expects the client to resolve by retrying the transaction.
+func isRetryable(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	return pqErr.Code == "40001" || pqErr.Code == "40P01"
+}
+
+// Run fn in a transaction, retrying the whole transaction with jittered
+// exponential backoff when it fails on contention. Returns
+// errWriteContention once every attempt has failed that way.
+func runWrite(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	backoff := 20 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := runTx(ctx, db, fn)
+		if !isRetryable(err) {
+			return err
+		}
+		if attempt == writeAttempts {
+			log.Printf("Write failed after %d attempts: %v", attempt, err)
+			return errWriteContention
+		}
+		select {
+		case <-time.After(backoff/2 + time.Duration(rand.Int63n(int64(backoff)))):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func runTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// readAttempts is how many times a read query is tried when the
+// connection drops under it; set from READ_RETRY_ATTEMPTS.
+var readAttempts = 2
+
+// Report whether err means the connection failed rather than the query,
+// as when a failover resets it or the server is shutting down
+func isConnectionError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code.Class() == "08" || pqErr.Code == "57P01" || pqErr.Code == "57P02" || pqErr.Code == "57P03"
+	}
+	return false
+}
+
+// Run a read, retrying after a short pause when it failed on a lost
+// connection. Any other error, sql.ErrNoRows included, returns at once.
+func runRead(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if attempt >= readAttempts || !isConnectionError(err) || ctx.Err() != nil {
+			return err
+		}
+		debugf("Read failed on attempt %d, retrying: %v", attempt, err)
+		select {
+		case <-time.After(time.Duration(attempt) * 50 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// db.QueryContext through runRead
+func queryRead(ctx context.Context, db *sql.DB, query string, args ...interface{}) (*sql.Rows, error) {
+	var rows *sql.Rows
+	err := runRead(ctx, func() (err error) {
+		rows, err = db.QueryContext(ctx, query, args...)
+		return err
+	})
+	return rows, err
+}
+
+// Report a failed write, answering 503 when it lost to contention
+func writeWriteError(w http.ResponseWriter, err error, message string) {
+	if err == errWriteContention {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusServiceUnavailable, "Database is busy, please retry")
+		return
+	}
+	writeError(w, http.StatusInternalServerError, message)
+}
+
+// Begin a transaction exempt from the connection's statement_timeout, for
+// work that is expected to run long such as exports and maintenance
+func beginUntimed(ctx context.Context, db *sql.DB) (*sql.Tx, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "SET LOCAL statement_timeout = 0"); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Create the table and bring older tables up to the current columns,
+// then the indexes the features need
+func ensureSchema(db *sql.DB) error {
+	statements := []string{
+		"CREATE TABLE IF NOT EXISTS " + table + " (id SERIAL PRIMARY KEY, F_name TEXT, L_name TEXT)",
+		"ALTER TABLE " + table + " ADD COLUMN IF NOT EXISTS view_count BIGINT NOT NULL DEFAULT 0",
+		"ALTER TABLE " + table + " ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}'",
+		"ALTER TABLE " + table + " ADD COLUMN IF NOT EXISTS active BOOLEAN NOT NULL DEFAULT true",
+		"ALTER TABLE " + table + " ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now()",
+		"ALTER TABLE " + table + " ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now()",
+	}
+	if outboxEnabled {
+		statements = append(statements,
+			"CREATE TABLE IF NOT EXISTS events_outbox (id BIGSERIAL PRIMARY KEY, table_name TEXT NOT NULL, "+
+				"payload JSONB NOT NULL, created_at TIMESTAMPTZ NOT NULL DEFAULT now(), published_at TIMESTAMPTZ)")
+	}
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return ensureIndexes(db)
+}
+
+// schemaIndex is an index ensureIndexes creates when it is missing.
+type schemaIndex struct {
+	name, on string
+}
+
+// Create the indexes behind most-viewed, tag filters, name sorting,
+// date ranges and, when pg_trgm is available, name search. Each index
+// actually created is logged.
+func ensureIndexes(db *sql.DB) error {
+	indexes := []schemaIndex{
+		{table + "_view_count_idx", table + " (view_count DESC)"},
+		{table + "_tags_idx", table + " USING GIN (tags)"},
+		{table + "_name_idx", table + " (L_name, F_name)"},
+		{table + "_created_at_idx", table + " (created_at)"},
+	}
+	// Trigram search needs pg_trgm, which may require a privileged role
+	// to install; without it ?q= searches fail but everything else works
+	if _, err := db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm"); err != nil {
+		log.Println("pg_trgm unavailable, name search disabled:", err)
+	} else {
+		indexes = append(indexes, schemaIndex{table + "_name_trgm_idx", table + " USING GIN (" + nameExpr + " gin_trgm_ops)"})
+	}
+	if outboxEnabled {
+		indexes = append(indexes, schemaIndex{"events_outbox_pending_idx", "events_outbox (table_name, id) WHERE published_at IS NULL"})
+	}
+
+	for _, idx := range indexes {
+		var exists bool
+		if err := db.QueryRow("SELECT to_regclass($1) IS NOT NULL", idx.name).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := db.Exec("CREATE INDEX IF NOT EXISTS " + idx.name + " ON " + idx.on); err != nil {
+			return fmt.Errorf("creating index %s: %v", idx.name, err)
+		}
+		log.Println("Created index", idx.name)
+	}
+	return nil
+}
+
+// Verify without DDL that the table and every column the app reads exist
+func checkSchema(db *sql.DB) error {
+	if _, err := db.Exec("SELECT " + selectList(userColumns) + " FROM " + table + " LIMIT 0"); err != nil {
+		return fmt.Errorf("table %s is missing or lacks columns %s: %v", table, selectList(userColumns), err)
+	}
+	if outboxEnabled {
+		if _, err := db.Exec("SELECT id, table_name, payload, published_at FROM events_outbox LIMIT 0"); err != nil {
+			return fmt.Errorf("events_outbox is missing: %v", err)
+		}
+	}
+	return nil
+}
+
+// columnInfo describes one column of the User model for form builders.
+type columnInfo struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable"`
+	Required bool   `json:"required"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+// userSchema mirrors the columns ensureSchema creates, in userColumns order.
+// Required marks what createUser insists on; read-only columns are set by
+// the server and ignored in request bodies.
+var userSchema = []columnInfo{
+	{Name: "id", Type: "integer", ReadOnly: true},
+	{Name: "F_name", Type: "text", Required: true},
+	{Name: "L_name", Type: "text", Nullable: true},
+	{Name: "view_count", Type: "bigint", ReadOnly: true},
+	{Name: "tags", Type: "text[]"},
+	{Name: "active", Type: "boolean", ReadOnly: true},
+	{Name: "created_at", Type: "timestamptz", ReadOnly: true},
+	{Name: "updated_at", Type: "timestamptz", ReadOnly: true},
+}
+
+// Describe the User model's columns
+func getSchema(w http.ResponseWriter, r *http.Request) {
+	columns := make([]columnInfo, len(userSchema))
+	for i, c := range userSchema {
+		c.Name = wireName(c.Name)
+		columns[i] = c
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"table": table, "columns": columns})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// inFlight counts requests currently being served.
+var inFlight int64
+
+// Track how many requests are in progress
+func inFlightMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Abort any response whose body grows past max bytes, before compression.
+// The connection is cut so the client cannot mistake the partial body for
+// a complete one.
+func maxResponseBytesMiddleware(max int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&limitWriter{ResponseWriter: w, r: r, max: max}, r)
+		})
+	}
+}
+
+// limitWriter counts the body bytes written through it.
+type limitWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	max     int64
+	written int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.written += int64(len(p)); l.written > l.max {
+		log.Printf("ERROR: %s %s response exceeded %d bytes, aborting", l.r.Method, l.r.URL.Path, l.max)
+		panic(http.ErrAbortHandler)
+	}
+	return l.ResponseWriter.Write(p)
+}
+
+func (l *limitWriter) Flush() {
+	if f, ok := l.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Listen on the Unix socket at LISTEN_SOCKET when set, otherwise on the
+// TCP port. A socket file left behind by a previous run is removed first.
+func listen(cfg Config) (net.Listener, error) {
+	if cfg.ListenSocket == "" {
+		log.Println("Server running on port " + cfg.Port)
+		return net.Listen("tcp", ":"+cfg.Port)
+	}
+	if err := os.Remove(cfg.ListenSocket); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	log.Println("Server running on socket " + cfg.ListenSocket)
+	return net.Listen("unix", cfg.ListenSocket)
+}
+
+// Serve until SIGINT or SIGTERM, then give in-flight requests up to
+// timeout to finish, logging how many are left while they drain
+func serve(server *http.Server, ln net.Listener, timeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() { errc <- server.Serve(ln) }()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-stop:
+		log.Printf("Received %s, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				log.Printf("Draining: %d requests in flight", atomic.LoadInt64(&inFlight))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	log.Printf("Draining %d in-flight requests (timeout %s)", atomic.LoadInt64(&inFlight), timeout)
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown timed out with %d requests in flight", atomic.LoadInt64(&inFlight))
+		return err
+	}
+	log.Println("All requests drained")
+	return nil
+}
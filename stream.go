@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ndjsonFlushEvery is how many records are written between flushes.
+const ndjsonFlushEvery = 100
+
+// Report whether the client asked for newline-delimited JSON
+func wantsNDJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "ndjson" ||
+		strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// Stream rows to the client as one JSON object per line while they are
+// read from the database. Once the first line is out the status is
+// committed, so later failures can only be logged. With a limit, rows
+// past it are dropped and the X-Result-Truncated trailer says so.
+func streamNDJSON(ctx context.Context, w http.ResponseWriter, rows *sql.Rows, next func(*sql.Rows) (interface{}, error), limit int) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if limit > 0 {
+		w.Header().Set("Trailer", "X-Result-Truncated")
+	}
+	w.WriteHeader(http.StatusOK)
+	enc := newJSONEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	n := 0
+	for rows.Next() {
+		if ctx.Err() != nil {
+			debugf("streamNDJSON: client disconnected after %d rows: %v", n, ctx.Err())
+			return
+		}
+		if limit > 0 && n == limit {
+			w.Header().Set("X-Result-Truncated", "true")
+			break
+		}
+		v, err := next(rows)
+		if err != nil {
+			log.Printf("streamNDJSON: schema mismatch after %d rows: %v", n, err)
+			return
+		}
+		if err := enc.Encode(v); err != nil {
+			return
+		}
+		n++
+		if flusher != nil && n%ndjsonFlushEvery == 0 {
+			flusher.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil && ctx.Err() == nil {
+		log.Printf("streamNDJSON: reading rows failed after %d rows: %v", n, err)
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// Export the whole table as one JSON array, encoding each row as it is
+// read so memory use stays flat however large the table is
+func exportJSON(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		tx, err := beginUntimed(ctx, db)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to retrieve users")
+			return
+		}
+		defer tx.Rollback()
+		rows, err := tx.QueryContext(ctx, "SELECT "+selectList(userColumns)+" FROM "+table+" ORDER BY id")
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to retrieve users")
+			return
+		}
+		defer rows.Close()
+
+		w.Header().Set("Content-Disposition", `attachment; filename="`+table+`.json"`)
+		w.WriteHeader(http.StatusOK)
+		enc := newJSONEncoder(w)
+
+		w.Write([]byte("["))
+		n := 0
+		for rows.Next() {
+			if ctx.Err() != nil {
+				debugf("exportJSON: client disconnected after %d rows: %v", n, ctx.Err())
+				return
+			}
+			var u User
+			if err := rows.Scan(scanTargets(&u, userColumns)...); err != nil {
+				log.Println("exportJSON: error scanning user:", err)
+				return
+			}
+			if n > 0 {
+				w.Write([]byte(","))
+			}
+			if err := enc.Encode(u); err != nil {
+				return
+			}
+			n++
+		}
+		if err := rows.Err(); err != nil {
+			if ctx.Err() == nil {
+				log.Println("exportJSON: error with rows:", err)
+			}
+			return
+		}
+		w.Write([]byte("]\n"))
+	}
+}
+
+// Export the users matching the list's filter, search and sort parameters
+// as CSV, streaming every match rather than stopping at the list cap
+func exportCSV(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lq, err := parseListQuery(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		lq.limit = 0
+
+		ctx := r.Context()
+		if ok, err := lq.checkCollation(ctx, db); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to retrieve users")
+			return
+		} else if !ok {
+			writeError(w, http.StatusBadRequest, "locale: no collation installed for "+r.URL.Query().Get("locale"))
+			return
+		}
+		tx, err := beginUntimed(ctx, db)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to retrieve users")
+			return
+		}
+		defer tx.Rollback()
+		rows, err := tx.QueryContext(ctx, lq.selectSQL(userColumns), lq.args...)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to retrieve users")
+			return
+		}
+		defer rows.Close()
+
+		// Name the file after what was exported
+		name := table
+		switch {
+		case lq.score != "":
+			name += "-search"
+		case len(lq.conds) > 0:
+			name += "-filtered"
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+		w.WriteHeader(http.StatusOK)
+
+		cw := csv.NewWriter(w)
+		header := make([]string, len(userColumns))
+		for i, c := range userColumns {
+			header[i] = wireName(c)
+		}
+		cw.Write(header)
+
+		n := 0
+		for rows.Next() {
+			if ctx.Err() != nil {
+				debugf("exportCSV: client disconnected after %d rows: %v", n, ctx.Err())
+				return
+			}
+			var u User
+			var score float64
+			targets := scanTargets(&u, userColumns)
+			if lq.score != "" {
+				targets = append(targets, &score)
+			}
+			if err := rows.Scan(targets...); err != nil {
+				log.Println("exportCSV: error scanning user:", err)
+				return
+			}
+			if err := cw.Write(csvRecord(u)); err != nil {
+				return
+			}
+			n++
+			if n%ndjsonFlushEvery == 0 {
+				cw.Flush()
+			}
+		}
+		if err := rows.Err(); err != nil {
+			if ctx.Err() == nil {
+				log.Println("exportCSV: error with rows:", err)
+			}
+			return
+		}
+		cw.Flush()
+	}
+}
+
+// One CSV row for u, in userColumns order. A missing L_name and timestamp
+// are left empty and tags are joined with commas.
+func csvRecord(u User) []string {
+	lName := ""
+	if u.L_name != nil {
+		lName = *u.L_name
+	}
+	formatTime := func(t Timestamp) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(timestampLayout)
+	}
+	return []string{
+		strconv.Itoa(int(u.ID)),
+		u.F_name,
+		lName,
+		strconv.FormatInt(u.ViewCount, 10),
+		strings.Join(u.Tags, ","),
+		strconv.FormatBool(u.Active),
+		formatTime(u.CreatedAt),
+		formatTime(u.UpdatedAt),
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Limits on a human's tags, set from MAX_TAGS and MAX_TAG_LENGTH.
+var (
+	maxTags      = 20
+	maxTagLength = 50
+)
+
+// Check the number and size of tags. An empty list is allowed.
+func validateTags(tags []string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	for i := range tags {
+		if err := cleanControlChars("tags", &tags[i]); err != nil {
+			return err
+		}
+		t := tags[i]
+		if strings.TrimSpace(t) == "" {
+			return fmt.Errorf("tags must not be blank")
+		}
+		if utf8.RuneCountInString(t) > maxTagLength {
+			return fmt.Errorf("tag %q is longer than %d characters", t, maxTagLength)
+		}
+	}
+	return nil
+}
+
+var errTooManyTags = errors.New("too many tags")
+
+// Add and remove tags in one UPDATE so concurrent edits to the same
+// human do not overwrite each other. Added tags that are already present
+// are not duplicated.
+func updateTags(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		var body struct {
+			Add    []string `json:"add"`
+			Remove []string `json:"remove"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		// A missing list decodes to nil, which pq sends as NULL, and
+		// tag <> ALL(NULL) would drop every tag
+		if body.Add == nil {
+			body.Add = []string{}
+		}
+		if body.Remove == nil {
+			body.Remove = []string{}
+		}
+		if err := validateTags(body.Add); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		// No stored tag holds a control character, but Postgres would
+		// still fail on a NUL in one to remove
+		for i := range body.Remove {
+			if err := cleanControlChars("tags", &body.Remove[i]); err != nil {
+				writeError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+		}
+
+		var u User
+		err := runWrite(r.Context(), db, func(tx *sql.Tx) error {
+			err := tx.QueryRowContext(r.Context(), "UPDATE "+table+" SET tags = ARRAY("+
+				"SELECT tag FROM unnest(tags || $1::text[]) WITH ORDINALITY AS t(tag, n) "+
+				"WHERE tag <> ALL($2::text[]) GROUP BY tag ORDER BY MIN(n)), updated_at = now() "+
+				"WHERE id = $3 RETURNING id, tags",
+				pq.Array(body.Add), pq.Array(body.Remove), id).Scan(&u.ID, pq.Array(&u.Tags))
+			if err != nil {
+				return err
+			}
+			if len(u.Tags) > maxTags {
+				return errTooManyTags
+			}
+			return enqueueEvent(r.Context(), tx, "update", map[string]interface{}{"id": u.ID, "tags": u.Tags})
+		})
+		switch {
+		case err == sql.ErrNoRows:
+			writeError(w, http.StatusNotFound, "User not found")
+			return
+		case err == errTooManyTags:
+			writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("at most %d tags are allowed", maxTags))
+			return
+		case err != nil:
+			writeWriteError(w, err, "Failed to update tags")
+			return
+		}
+		notifyChange("update", map[string]interface{}{"id": u.ID, "tags": u.Tags})
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": u.ID, "tags": u.Tags})
+	}
+}
+
+// tagMatchingMax is how many humans one tag-matching request may change
+// without "confirm": true.
+const tagMatchingMax = 1000
+
+var errTooManyMatches = errors.New("too many matches")
+
+// Add a tag to every human matching a filter, given in the body with the
+// list's query parameter names, e.g. {"filter": {"q": "ann"}, "tag": "vip"}.
+// Humans that already have the tag or have no room for it are left alone.
+// Changes are recorded in the outbox but not sent to the webhook.
+func tagMatching(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Filter  map[string]string `json:"filter"`
+			Tag     string            `json:"tag"`
+			Confirm bool              `json:"confirm"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, `Body must be {"filter": {...}, "tag": "..."}`)
+			return
+		}
+		tags := []string{body.Tag}
+		if err := validateTags(tags); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		body.Tag = tags[0]
+
+		params := url.Values{}
+		for k, v := range body.Filter {
+			params.Set(k, v)
+		}
+		lq, err := parseListParams(params)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(lq.conds) == 0 && !body.Confirm {
+			writeError(w, http.StatusBadRequest, `A filter is required unless "confirm" is true`)
+			return
+		}
+		tag := lq.arg(body.Tag)
+		conds := append(lq.conds, "NOT tags @> ARRAY["+tag+"::text]", "cardinality(tags) < "+strconv.Itoa(maxTags))
+		query := "UPDATE " + table + " SET tags = array_append(tags, " + tag + "::text), updated_at = now()" +
+			" WHERE " + strings.Join(conds, " AND ") + " RETURNING " + selectList(userColumns)
+
+		ctx := r.Context()
+		tagged := 0
+		err = runWrite(ctx, db, func(tx *sql.Tx) error {
+			rows, err := tx.QueryContext(ctx, query, lq.args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			var changed []User
+			for rows.Next() {
+				var u User
+				if err := rows.Scan(scanTargets(&u, userColumns)...); err != nil {
+					return err
+				}
+				changed = append(changed, u)
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			tagged = len(changed)
+			if tagged > tagMatchingMax && !body.Confirm {
+				return errTooManyMatches
+			}
+			for _, u := range changed {
+				if err := enqueueEvent(ctx, tx, "update", u); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err == errTooManyMatches {
+			writeErrorDetails(w, http.StatusConflict, fmt.Sprintf("Filter matches more than %d humans; resend with \"confirm\": true", tagMatchingMax),
+				map[string]interface{}{"matched": tagged})
+			return
+		} else if err != nil {
+			writeWriteError(w, err, "Failed to tag users")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]int{"tagged": tagged})
+	}
+}
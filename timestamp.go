@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"fmt"
+	"time"
+)
+
+// timestampLayout is how every timestamp leaves the API: UTC with
+// millisecond precision.
+const timestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// Timestamp is a time.Time with a fixed JSON format. The zero value
+// encodes as null.
+type Timestamp struct {
+	time.Time
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return []byte(`"` + t.UTC().Format(timestampLayout) + `"`), nil
+}
+
+func (t *Timestamp) UnmarshalJSON(b []byte) error {
+	if bytes.Equal(b, []byte("null")) {
+		t.Time = time.Time{}
+		return nil
+	}
+	if len(b) < 2 || b[0] != '"' || b[len(b)-1] != '"' {
+		return fmt.Errorf("timestamp must be a string")
+	}
+	parsed, err := parseTimestamp(string(b[1 : len(b)-1]))
+	if err != nil {
+		return err
+	}
+	t.Time = parsed
+	return nil
+}
+
+// Parse an RFC 3339 timestamp. One without a zone is taken to be UTC.
+func parseTimestamp(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02T15:04:05.999999999", s, time.UTC)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q, expected RFC 3339", s)
+	}
+	return t, nil
+}
+
+func (t *Timestamp) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		t.Time = time.Time{}
+	case time.Time:
+		t.Time = v
+	default:
+		return fmt.Errorf("cannot scan %T into Timestamp", src)
+	}
+	return nil
+}
+
+func (t Timestamp) Value() (driver.Value, error) {
+	if t.IsZero() {
+		return nil, nil
+	}
+	return t.Time, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultNamePattern allows letters in any script, with their combining
+// marks, plus spaces, hyphens and apostrophes.
+const defaultNamePattern = `^[\p{L}\p{M} '\-]+$`
+
+// Name rules, set from NAME_MAX_LENGTH and NAME_PATTERN.
+var (
+	nameMaxLength = 100
+	namePattern   = regexp.MustCompile(defaultNamePattern)
+)
+
+// controlChars is what happens to control characters such as NUL in
+// names and tags, set from CONTROL_CHARS: "reject" answers 422 and
+// "strip" removes them before the other checks run.
+var controlChars = "reject"
+
+// Check a user submitted for create. F_name is required; a blank L_name
+// is stored as NULL, since mononymous humans have no last name.
+func validateCreate(u *User) error {
+	if err := cleanNames(u, map[string]bool{"F_name": true, "L_name": true}); err != nil {
+		return err
+	}
+	if strings.TrimSpace(u.F_name) == "" {
+		return errors.New(wireName("F_name") + " is required")
+	}
+	normalizeLName(u)
+	if err := validateNames(u, map[string]bool{"F_name": true, "L_name": true}); err != nil {
+		return err
+	}
+	return validateTags(u.Tags)
+}
+
+// Check a partial update. Only the fields present in the body are
+// validated, by the same rules as on create.
+func validateUpdate(u *User, present map[string]bool) error {
+	if err := cleanNames(u, present); err != nil {
+		return err
+	}
+	if present["F_name"] && strings.TrimSpace(u.F_name) == "" {
+		return errors.New(wireName("F_name") + " cannot be blank")
+	}
+	normalizeLName(u)
+	if err := validateNames(u, present); err != nil {
+		return err
+	}
+	if present["tags"] {
+		return validateTags(u.Tags)
+	}
+	return nil
+}
+
+func normalizeLName(u *User) {
+	if u.L_name != nil && strings.TrimSpace(*u.L_name) == "" {
+		u.L_name = nil
+	}
+}
+
+// Reject or strip control characters in the names being written
+func cleanNames(u *User, present map[string]bool) error {
+	if present["F_name"] {
+		if err := cleanControlChars(wireName("F_name"), &u.F_name); err != nil {
+			return err
+		}
+	}
+	if present["L_name"] && u.L_name != nil {
+		return cleanControlChars(wireName("L_name"), u.L_name)
+	}
+	return nil
+}
+
+// Postgres refuses NUL in text, and the other control characters are
+// never wanted in stored strings
+func cleanControlChars(field string, s *string) error {
+	if strings.IndexFunc(*s, unicode.IsControl) < 0 {
+		return nil
+	}
+	if controlChars == "strip" {
+		*s = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, *s)
+		return nil
+	}
+	return fmt.Errorf("%s must not contain control characters", field)
+}
+
+// Apply the length and character rules to the names being written
+func validateNames(u *User, present map[string]bool) error {
+	names := map[string]*string{"F_name": &u.F_name, "L_name": u.L_name}
+	for _, field := range []string{"F_name", "L_name"} {
+		name := names[field]
+		if !present[field] || name == nil {
+			continue
+		}
+		if utf8.RuneCountInString(*name) > nameMaxLength {
+			return fmt.Errorf("%s is longer than %d characters", wireName(field), nameMaxLength)
+		}
+		if !namePattern.MatchString(*name) {
+			return fmt.Errorf("%s contains characters that are not allowed (must match %s)", wireName(field), namePattern)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// viewCounter buffers getUser view increments in memory and writes them
+// in one statement per flush, so a popular record costs one UPDATE per
+// interval instead of one per read.
+type viewCounter struct {
+	mu      sync.Mutex
+	pending map[int]int64
+}
+
+func newViewCounter() *viewCounter {
+	return &viewCounter{pending: map[int]int64{}}
+}
+
+// Record a view of id and return how many views of it are still unflushed
+func (v *viewCounter) add(id int) int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.pending[id]++
+	return v.pending[id]
+}
+
+// Write all pending increments to the database
+func (v *viewCounter) flush(db *sql.DB) {
+	v.mu.Lock()
+	pending := v.pending
+	v.pending = map[int]int64{}
+	v.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	ids := make([]int64, 0, len(pending))
+	counts := make([]int64, 0, len(pending))
+	for id, n := range pending {
+		ids = append(ids, int64(id))
+		counts = append(counts, n)
+	}
+	_, err := db.Exec("UPDATE "+table+" AS t SET view_count = t.view_count + v.n "+
+		"FROM unnest($1::bigint[], $2::bigint[]) AS v(id, n) WHERE t.id = v.id",
+		pq.Array(ids), pq.Array(counts))
+	if err != nil {
+		log.Printf("Failed to flush %d view counts: %v", len(pending), err)
+	}
+}
+
+// Flush pending increments every interval
+func (v *viewCounter) run(db *sql.DB, interval time.Duration) {
+	for range time.Tick(interval) {
+		v.flush(db)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// webhookURL receives a best-effort POST after every committed change;
+// empty disables notifications. Set from WEBHOOK_URL.
+var webhookURL string
+
+var webhookClient = &http.Client{Timeout: 3 * time.Second}
+
+// Notify the webhook of a change in the background. Failures are retried
+// twice and then logged; they never affect the API response.
+func notifyChange(operation string, record interface{}) {
+	if webhookURL == "" {
+		return
+	}
+	payload, err := json.Marshal(changeEvent{Operation: operation, Table: table, Record: record})
+	if err != nil {
+		log.Println("Webhook: failed to encode event:", err)
+		return
+	}
+
+	go func() {
+		const attempts = 3
+		for attempt := 1; ; attempt++ {
+			err := postWebhook(payload)
+			if err == nil {
+				return
+			}
+			if attempt == attempts {
+				log.Printf("Webhook: giving up on %s event after %d attempts: %v", operation, attempt, err)
+				return
+			}
+			time.Sleep(time.Duration(attempt) * 500 * time.Millisecond)
+		}
+	}()
+}
+
+func postWebhook(payload []byte) error {
+	resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+// jsonEscapeHTML makes JSON output escape <, > and & as \u003c and so on,
+// as encoding/json does by default; JSON_ESCAPE_HTML=false turns it off.
+var jsonEscapeHTML = true
+
+// A JSON encoder writing to w with the configured HTML escaping
+func newJSONEncoder(w io.Writer) *json.Encoder {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(jsonEscapeHTML)
+	return enc
+}
+
+// json.Marshal with the configured HTML escaping
+func marshalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := newJSONEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// jsonFieldStyle is how User fields are named on the wire, set from
+// JSON_FIELD_STYLE: "legacy" keeps the column names (F_name), "snake"
+// gives first_name and "camel" firstName.
+var jsonFieldStyle = "legacy"
+
+// jsonFieldStyles maps each style to its renamed fields; fields not
+// listed keep their internal name.
+var jsonFieldStyles = map[string]map[string]string{
+	"legacy": {},
+	"snake":  {"F_name": "first_name", "L_name": "last_name"},
+	"camel": {"F_name": "firstName", "L_name": "lastName", "view_count": "viewCount",
+		"created_at": "createdAt", "updated_at": "updatedAt", "full_name": "fullName"},
+}
+
+// Wire name of an internal field name in the configured style
+func wireName(field string) string {
+	if name, ok := jsonFieldStyles[jsonFieldStyle][field]; ok {
+		return name
+	}
+	return field
+}
+
+// Internal field name for a name a client sent. Names the style does
+// not rename pass through unchanged; an internal name the style renames
+// is not a name in this style and gives "".
+func internalName(name string) string {
+	renames := jsonFieldStyles[jsonFieldStyle]
+	for field, wire := range renames {
+		if wire == name {
+			return field
+		}
+	}
+	if _, renamed := renames[name]; renamed {
+		return ""
+	}
+	return name
+}
+
+// The wire forms of User, one per style. They mirror User field for field
+// so they convert to and from it directly.
+type (
+	legacyUser struct {
+		ID        UserID    `json:"id"`
+		F_name    string    `json:"F_name"`
+		L_name    *string   `json:"L_name"`
+		ViewCount int64     `json:"view_count"`
+		Tags      []string  `json:"tags"`
+		Active    bool      `json:"active"`
+		CreatedAt Timestamp `json:"created_at"`
+		UpdatedAt Timestamp `json:"updated_at"`
+	}
+	snakeUser struct {
+		ID        UserID    `json:"id"`
+		F_name    string    `json:"first_name"`
+		L_name    *string   `json:"last_name"`
+		ViewCount int64     `json:"view_count"`
+		Tags      []string  `json:"tags"`
+		Active    bool      `json:"active"`
+		CreatedAt Timestamp `json:"created_at"`
+		UpdatedAt Timestamp `json:"updated_at"`
+	}
+	camelUser struct {
+		ID        UserID    `json:"id"`
+		F_name    string    `json:"firstName"`
+		L_name    *string   `json:"lastName"`
+		ViewCount int64     `json:"viewCount"`
+		Tags      []string  `json:"tags"`
+		Active    bool      `json:"active"`
+		CreatedAt Timestamp `json:"createdAt"`
+		UpdatedAt Timestamp `json:"updatedAt"`
+	}
+)
+
+func (u User) MarshalJSON() ([]byte, error) {
+	switch jsonFieldStyle {
+	case "snake":
+		return marshalJSON(snakeUser(u))
+	case "camel":
+		return marshalJSON(camelUser(u))
+	}
+	return marshalJSON(legacyUser(u))
+}
+
+func (u *User) UnmarshalJSON(b []byte) error {
+	switch jsonFieldStyle {
+	case "snake":
+		var v snakeUser
+		err := json.Unmarshal(b, &v)
+		*u = User(v)
+		return err
+	case "camel":
+		var v camelUser
+		err := json.Unmarshal(b, &v)
+		*u = User(v)
+		return err
+	}
+	var v legacyUser
+	err := json.Unmarshal(b, &v)
+	*u = User(v)
+	return err
+}
+
+// MarshalJSON adds the score to the user's own encoding, which embedding
+// alone would drop now that User marshals itself.
+func (s scoredUser) MarshalJSON() ([]byte, error) {
+	b, err := s.User.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return append(b[:len(b)-1], `,"score":`+strconv.FormatFloat(s.Score, 'g', -1, 64)+`}`...), nil
+}